@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/avinetworks/sdk/go/models"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// alertLevels lists the levels of Avi alerts.
+var alertLevels = []string{"ALERT_LOW", "ALERT_MEDIUM", "ALERT_HIGH"}
+
+// alertStore counts the alerts raised per level. Alerts are told apart by
+// uuid, so an alert is only counted the first time it is seen.
+type alertStore struct {
+	mtx    sync.Mutex
+	seen   map[string]bool
+	totals map[string]float64
+}
+
+func newAlertStore() (r *alertStore) {
+	r = new(alertStore)
+	r.seen = make(map[string]bool)
+	r.totals = make(map[string]float64)
+	for _, v := range alertLevels {
+		r.totals[v] = 0
+	}
+	return
+}
+
+// add counts the alerts not seen before and returns the totals per level.
+// Only the uuids of the current alerts are kept.
+func (o *alertStore) add(alerts []*models.Alert) (r map[string]float64) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	seen := make(map[string]bool)
+	for _, v := range alerts {
+		if v == nil || v.UUID == nil || v.Level == nil {
+			continue
+		}
+		seen[*v.UUID] = true
+		if !o.seen[*v.UUID] {
+			o.totals[*v.Level]++
+		}
+	}
+	o.seen = seen
+	r = make(map[string]float64)
+	for k, v := range o.totals {
+		r[k] = v
+	}
+	return
+}
+
+// fetchAlertConfigs retrieves every alert config from Avi, a page at a time.
+func (o *Exporter) fetchAlertConfigs(ctx context.Context) (r map[string]alertConfigDef, err error) {
+	r = make(map[string]alertConfigDef)
+	err = o.fetchPages(ctx, "api/alertconfig", nil, func(obj json.RawMessage) error {
+		var v models.AlertConfig
+		if err := json.Unmarshal(obj, &v); err != nil {
+			return err
+		}
+		if v.UUID == nil || v.Name == nil {
+			o.skip("alertconfig", "missing uuid or name")
+			return nil
+		}
+		def := alertConfigDef{Name: *v.Name}
+		if v.ObjectType != nil {
+			def.ObjectType = *v.ObjectType
+		}
+		r[*v.UUID] = def
+		return nil
+	})
+	return
+}
+
+// fetchAlerts retrieves the alerts Avi currently has, a page at a time.
+func (o *Exporter) fetchAlerts(ctx context.Context) (r []*models.Alert, err error) {
+	err = o.fetchPages(ctx, "api/alert", map[string]string{"include_name": "true"}, func(obj json.RawMessage) error {
+		v := new(models.Alert)
+		if err := json.Unmarshal(obj, v); err != nil {
+			return err
+		}
+		r = append(r, v)
+		return nil
+	})
+	return
+}
+
+// setAlertMetrics reports the active alerts, counted per alert config, level
+// and object, and the number of alerts raised per level. Dismissed alerts are
+// not active.
+func (o *Exporter) setAlertMetrics(s *scheduler, m *metricSet) (err error) {
+	if !o.currentConfig().Collectors.Alerts {
+		return
+	}
+	c := o.currentCatalog()
+	var configs map[string]alertConfigDef
+	var alerts []*models.Alert
+	err = s.run(
+		func() error { return s.call(func() (err error) { configs, err = o.getAlertConfigs(s.ctx); return }) },
+		func() error { return s.fetch(func() (err error) { alerts, err = o.fetchAlerts(s.ctx); return }) },
+	)
+	if err != nil {
+		return
+	}
+	type alertKey struct {
+		config, level, objectType, objectName, tenant string
+	}
+	active := make(map[alertKey]float64)
+	for _, v := range alerts {
+		if v == nil || v.UUID == nil || v.Level == nil || v.AlertConfigRef == nil {
+			o.skip("alert", "missing uuid, level or alert config")
+			continue
+		}
+		if v.State != nil && *v.State == "ALERT_STATE_DISMISSED" {
+			continue
+		}
+		config := configs[refUUID(*v.AlertConfigRef)]
+		k := alertKey{config: config.Name, level: *v.Level, objectType: config.ObjectType}
+		if k.config == "" {
+			k.config = refName(*v.AlertConfigRef)
+		}
+		if v.ObjName != nil {
+			k.objectName = *v.ObjName
+		}
+		if v.TenantRef != nil {
+			k.tenant = refName(*v.TenantRef)
+		}
+		active[k]++
+	}
+	for k, v := range active {
+		var labels prometheus.Labels
+		labels = make(map[string]string)
+		labels["alert_config"] = k.config
+		labels["level"] = k.level
+		labels["object_type"] = k.objectType
+		labels["object_name"] = k.objectName
+		labels["tenant"] = k.tenant
+		labels["cluster"] = o.clusterLabel()
+		metrics, err := c.newMetrics("avi_alert_active", labels, v)
+		if err != nil {
+			return err
+		}
+		m.add(metrics...)
+	}
+	for level, v := range o.alerts.add(alerts) {
+		metrics, err := c.newMetrics("avi_alerts_total", prometheus.Labels{"level": level, "cluster": o.clusterLabel()}, v)
+		if err != nil {
+			return err
+		}
+		m.add(metrics...)
+	}
+	return
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestFetchAlertsPages(t *testing.T) {
+	server, _ := newFakeAPI(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/alert" {
+			w.Write([]byte(`{}`))
+			return
+		}
+		switch req.URL.Query().Get("page") {
+		case "1":
+			w.Write([]byte(`{"count": 3, "results": [{"uuid": "alert-1"}, {"uuid": "alert-2"}]}`))
+		case "2":
+			w.Write([]byte(`{"count": 3, "results": [{"uuid": "alert-3"}]}`))
+		default:
+			w.Write([]byte(`{"count": 3, "results": []}`))
+		}
+	})
+	defer server.Close()
+	o := newSessionTestExporter(server, 1)
+	alerts, err := o.fetchAlerts(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 3 || *alerts[2].UUID != "alert-3" {
+		t.Errorf("got %d alerts, want the 3 of both pages", len(alerts))
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// entityTypes lists the entity types the exporter collects metrics for.
+var entityTypes = []string{"virtualservice", "serviceengine", "controller", "pool", "server"}
+
+// optionalEntityTypes lists the entity types added after the first release,
+// whose metric files deployments that mount their own files may not have.
+var optionalEntityTypes = map[string]bool{"pool": true, "server": true}
+
+// customLabels lists the labels of each entity type's metrics.
+var customLabels = map[string][]string{
+	"virtualservice": {"name", "entity_uuid", "fqdn", "ipaddress", "pool", "tenant_uuid", "units", "cluster"},
+	"serviceengine":  {"name", "entity_uuid", "fqdn", "ipaddress", "tenant_uuid", "units", "cluster"},
+	"controller":     {"name", "entity_uuid", "fqdn", "ipaddress", "tenant_uuid", "units", "cluster"},
+	"pool":           {"name", "pool_uuid", "entity_uuid", "virtualservice", "tenant_uuid", "units", "cluster"},
+	"server":         {"server_ip", "server_port", "server_hostname", "pool", "virtualservice", "tenant_uuid", "units", "cluster"},
+}
+
+// metricKey returns the key of a metric in the catalog. Pool and server
+// metrics share their ids with virtual service metrics, so their keys are
+// prefixed.
+func metricKey(entityType string, id string) string {
+	if entityType == "pool" || entityType == "server" {
+		return entityType + "." + id
+	}
+	return id
+}
+
+// catalog is an immutable set of metric definitions and their descriptors.
+// Changing the metric set means swapping in a new catalog.
+type catalog struct {
+	GaugeOptsMap GaugeOptsMap
+	naming       NamingConfig
+	descs        map[string][]catalogDesc
+	known        map[*prometheus.Desc]bool
+	knownStrings map[string]bool
+}
+
+// catalogDesc is one of the series an Avi metric is exported as, with the
+// labels of its descriptor and the factor applied to its values.
+type catalogDesc struct {
+	desc   *prometheus.Desc
+	labels []string
+	scale  float64
+}
+
+// newCatalog builds the descriptors of every metric definition: the legacy
+// one, the conformant one, or both while migrating between them. State
+// metrics are always part of the catalog, under their own name.
+func newCatalog(m GaugeOptsMap, n NamingConfig) (r *catalog) {
+	r = &catalog{
+		GaugeOptsMap: m,
+		naming:       n,
+		descs:        make(map[string][]catalogDesc),
+		known:        make(map[*prometheus.Desc]bool),
+		knownStrings: make(map[string]bool),
+	}
+	for k, v := range m {
+		name, scale, ok := conformantName(v, n)
+		if n.Conformant && ok {
+			labels := withoutLabel(v.CustomLabels, "units")
+			r.add(k, catalogDesc{prometheus.NewDesc(name, v.GaugeOpts.Help, labels, nil), labels, scale})
+		}
+		if !n.Conformant || !ok || n.KeepLegacy {
+			r.add(k, catalogDesc{prometheus.NewDesc(v.GaugeOpts.Name, v.GaugeOpts.Help, v.CustomLabels, nil), v.CustomLabels, 1})
+		}
+	}
+	for k, v := range stateMetrics {
+		r.add(k, catalogDesc{prometheus.NewDesc(k, v.help, v.labels, nil), v.labels, 1})
+	}
+	return
+}
+
+func (o *catalog) add(id string, d catalogDesc) {
+	o.descs[id] = append(o.descs[id], d)
+	o.known[d.desc] = true
+	o.knownStrings[d.desc.String()] = true
+}
+
+// describes reports whether the catalog has the descriptor. Metrics built
+// from an older catalog are matched on the descriptor's definition, so that
+// a snapshot taken before a catalog change only loses the removed metrics.
+func (o *catalog) describes(d *prometheus.Desc) bool {
+	return o.known[d] || o.knownStrings[d.String()]
+}
+
+// collects reports whether the catalog has metrics of the entity type.
+func (o *catalog) collects(entityType string) bool {
+	for _, v := range o.GaugeOptsMap {
+		if v.Type == entityType {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *Exporter) currentCatalog() *catalog {
+	c, _ := o.catalog.Load().(*catalog)
+	return c
+}
+
+// setCatalog swaps in a new metric catalog. The exporter is registered on a
+// fresh registry so that its descriptors match the new catalog, and the
+// registry is swapped in one step; scrapes see either the old or the new set.
+func (o *Exporter) setCatalog(c *catalog) (err error) {
+	o.catalogMtx.Lock()
+	defer o.catalogMtx.Unlock()
+	old := o.currentCatalog()
+	o.catalog.Store(c)
+	reg := prometheus.NewRegistry()
+	if err = reg.Register(o); err != nil {
+		if old != nil {
+			o.catalog.Store(old)
+		}
+		return
+	}
+	for _, v := range o.selfCollectors {
+		if err = reg.Register(v); err != nil {
+			if old != nil {
+				o.catalog.Store(old)
+			}
+			return
+		}
+	}
+	o.registry.Store(reg)
+	return
+}
+
+// Gather implements prometheus.Gatherer using the current registry.
+func (o *Exporter) Gather() ([]*dto.MetricFamily, error) {
+	return o.registry.Load().(*prometheus.Registry).Gather()
+}
+
+// sameMetrics reports whether two metric sets define the same metrics.
+func sameMetrics(a GaugeOptsMap, b GaugeOptsMap) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		w, ok := b[k]
+		if !ok || v.Type != w.Type || v.MetricID != w.MetricID || v.GaugeOpts.Name != w.GaugeOpts.Name || v.GaugeOpts.Help != w.GaugeOpts.Help ||
+			v.MetricType != w.MetricType || v.Units != w.Units || v.Step != w.Step || v.Limit != w.Limit || v.MetricEntity != w.MetricEntity || v.Reduction != w.Reduction {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/avinetworks/sdk/go/models"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// certificateFields limits the certificates fetched to what the metrics use,
+// which leaves out the private keys.
+var certificateFields = map[string]string{"fields": "uuid,name,tenant_ref,type,certificate,key_params"}
+
+// certTimeLayouts lists the layouts Avi formats certificate validity in.
+var certTimeLayouts = []string{"2006-01-02 15:04:05", time.RFC3339}
+
+// ecKeySizes maps the EC curves to their key size.
+var ecKeySizes = map[string]string{
+	"SSL_KEY_EC_CURVE_SECP256R1": "256",
+	"SSL_KEY_EC_CURVE_SECP384R1": "384",
+	"SSL_KEY_EC_CURVE_SECP521R1": "521",
+}
+
+// fetchCertificates retrieves every SSL key and certificate from Avi, a page
+// at a time.
+func (o *Exporter) fetchCertificates(ctx context.Context) (r map[string]certDef, err error) {
+	r = make(map[string]certDef)
+	err = o.fetchPages(ctx, "api/sslkeyandcertificate", certificateFields, func(obj json.RawMessage) error {
+		v := new(models.SSLKeyAndCertificate)
+		if err := json.Unmarshal(obj, v); err != nil {
+			return err
+		}
+		if def, ok := o.newCertDef(v); ok {
+			r[*v.UUID] = def
+		}
+		return nil
+	})
+	return
+}
+
+// newCertDef maps a certificate. Certificates whose validity cannot be read,
+// such as pending certificate signing requests, are skipped.
+func (o *Exporter) newCertDef(v *models.SSLKeyAndCertificate) (r certDef, ok bool) {
+	if v == nil || v.UUID == nil || v.Name == nil {
+		o.skip("sslkeyandcertificate", "missing uuid or name")
+		return
+	}
+	r = certDef{Name: *v.Name}
+	if v.TenantRef != nil {
+		r.TenantUUID = formatAviRef(*v.TenantRef)
+	}
+	if v.Type != nil {
+		r.Type = *v.Type
+	}
+	cert := v.Certificate
+	if cert == nil {
+		o.skip("sslkeyandcertificate", "no certificate in "+*v.Name)
+		return
+	}
+	if cert.Subject != nil && cert.Subject.CommonName != nil {
+		r.CommonName = *cert.Subject.CommonName
+	}
+	if cert.Issuer != nil && cert.Issuer.CommonName != nil {
+		r.Issuer = *cert.Issuer.CommonName
+	}
+	r.SANs = cert.SubjectAltNames
+	var notBefore, notAfter bool
+	r.NotBefore, notBefore = parseCertTime(cert.NotBefore)
+	r.NotAfter, notAfter = parseCertTime(cert.NotAfter)
+	if (!notBefore || !notAfter) && cert.Certificate != nil {
+		if block, _ := pem.Decode([]byte(*cert.Certificate)); block != nil {
+			if parsed, err := x509.ParseCertificate(block.Bytes); err == nil {
+				r.NotBefore, r.NotAfter = parsed.NotBefore, parsed.NotAfter
+				notBefore, notAfter = true, true
+				if r.CommonName == "" {
+					r.CommonName = parsed.Subject.CommonName
+				}
+				if r.Issuer == "" {
+					r.Issuer = parsed.Issuer.CommonName
+				}
+				if len(r.SANs) == 0 {
+					r.SANs = parsed.DNSNames
+				}
+			}
+		}
+	}
+	if !notBefore || !notAfter {
+		o.skip("sslkeyandcertificate", "no validity in "+*v.Name)
+		return
+	}
+	params := v.KeyParams
+	if params == nil {
+		params = cert.KeyParams
+	}
+	if params != nil && params.Algorithm != nil {
+		r.KeyAlgorithm = strings.TrimPrefix(*params.Algorithm, "SSL_KEY_ALGORITHM_")
+		if params.RsaParams != nil && params.RsaParams.KeySize != nil {
+			r.KeySize = strings.TrimSuffix(strings.TrimPrefix(*params.RsaParams.KeySize, "SSL_KEY_"), "_BITS")
+		}
+		if params.EcParams != nil && params.EcParams.Curve != nil {
+			r.KeySize = ecKeySizes[*params.EcParams.Curve]
+		}
+	}
+	return r, true
+}
+
+// parseCertTime parses a validity bound of a certificate.
+func parseCertTime(v *string) (r time.Time, ok bool) {
+	if v == nil {
+		return
+	}
+	for _, layout := range certTimeLayouts {
+		if t, err := time.Parse(layout, *v); err == nil {
+			return t, true
+		}
+	}
+	return
+}
+
+// sansHash identifies the subject alternative names of a certificate, which
+// are too long to be a label themselves.
+func sansHash(sans []string) string {
+	if len(sans) == 0 {
+		return ""
+	}
+	sorted := append([]string(nil), sans...)
+	sort.Strings(sorted)
+	sum := sha256.Sum256([]byte(strings.Join(sorted, ",")))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// setCertificateMetrics reports the validity of every certificate, along with
+// the virtual services that would serve it.
+func (o *Exporter) setCertificateMetrics(s *scheduler, m *metricSet) (err error) {
+	if !o.currentConfig().Collectors.Certificates {
+		return
+	}
+	c := o.currentCatalog()
+	var certs map[string]certDef
+	var vs map[string]virtualServiceDef
+	err = s.run(
+		func() error { return s.call(func() (err error) { certs, err = o.getCertificates(s.ctx); return }) },
+		func() error { return s.call(func() (err error) { vs, err = o.getVirtualServices(s.ctx); return }) },
+	)
+	if err != nil {
+		return
+	}
+	users := make(map[string][]string)
+	for _, v := range vs {
+		for _, uuid := range v.CertUUIDs {
+			users[uuid] = append(users[uuid], v.Name)
+		}
+	}
+	for uuid, v := range certs {
+		names, _ := sortUniqueKeys(users[uuid])
+		var labels prometheus.Labels
+		labels = make(map[string]string)
+		labels["name"] = v.Name
+		labels["common_name"] = v.CommonName
+		labels["issuer"] = v.Issuer
+		labels["sans_hash"] = sansHash(v.SANs)
+		labels["tenant_uuid"] = v.TenantUUID
+		labels["virtualservices"] = strings.Join(names, ",")
+		labels["type"] = v.Type
+		labels["key_algorithm"] = v.KeyAlgorithm
+		labels["key_size"] = v.KeySize
+		labels["cluster"] = o.clusterLabel()
+		values := map[string]float64{
+			"avi_ssl_certificate_not_after_timestamp_seconds":  float64(v.NotAfter.Unix()),
+			"avi_ssl_certificate_not_before_timestamp_seconds": float64(v.NotBefore.Unix()),
+			"avi_ssl_certificate_info":                         1,
+		}
+		for name, value := range values {
+			metrics, err := c.newMetrics(name, labels, value)
+			if err != nil {
+				return err
+			}
+			m.add(metrics...)
+		}
+	}
+	return
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/avinetworks/sdk/go/clients"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// controllerRoles lists the roles of controller nodes.
+var controllerRoles = []string{"CLUSTER_LEADER", "CLUSTER_FOLLOWER"}
+
+// clusterStates lists the states avi_controller_cluster_state always has a
+// series for.
+var clusterStates = []string{"CLUSTER_UP_HA_ACTIVE", "CLUSTER_UP_HA_COMPROMISED", "CLUSTER_UP_NO_HA", "CLUSTER_DOWN"}
+
+// fetchRuntime retrieves the runtime of the controller cluster.
+func (o *Exporter) fetchRuntime(ctx context.Context) (r Runtime, err error) {
+	err = o.withSession(ctx, func(c *clients.AviClient) error {
+		return c.AviSession.Get("api/cluster/runtime", &r)
+	})
+	return
+}
+
+// runtimeFetch shares one retrieval of the cluster runtime between the phases
+// of a scrape.
+type runtimeFetch struct {
+	once    sync.Once
+	runtime Runtime
+	err     error
+}
+
+// get retrieves the cluster runtime on the first call and returns the same
+// result to the next ones.
+func (o *runtimeFetch) get(e *Exporter, s *scheduler) (r Runtime, err error) {
+	err = s.fetch(func() error {
+		o.once.Do(func() { o.runtime, o.err = e.fetchRuntime(s.ctx) })
+		return o.err
+	})
+	return o.runtime, err
+}
+
+// setControllerStateMetrics reports the state and role of every controller
+// node, the state of the services running on them and the cluster leader.
+func (o *Exporter) setControllerStateMetrics(s *scheduler, m *metricSet, f *runtimeFetch) (err error) {
+	if !o.currentConfig().Collectors.Cluster {
+		return
+	}
+	c := o.currentCatalog()
+	runtime, err := f.get(o, s)
+	if err != nil {
+		return
+	}
+	add := func(metrics []prometheus.Metric, err error) error {
+		if err == nil {
+			m.add(metrics...)
+		}
+		return err
+	}
+	leader := ""
+	addresses := make(map[string]string)
+	for _, v := range runtime.NodeStates {
+		addresses[v.Name] = v.MgmtIP
+		if v.Role == "CLUSTER_LEADER" {
+			leader = v.Name
+		}
+		var labels prometheus.Labels
+		labels = make(map[string]string)
+		labels["node"] = v.Name
+		labels["mgmt_ip"] = v.MgmtIP
+		labels["cluster"] = o.clusterLabel()
+		up := 0.0
+		if v.State == "CLUSTER_ACTIVE" {
+			up = 1
+		}
+		if err = add(c.newMetrics("avi_controller_node_up", labels, up)); err != nil {
+			return
+		}
+		if err = add(c.newStateSet("avi_controller_node_role", labels, "role", controllerRoles, v.Role)); err != nil {
+			return
+		}
+	}
+	for _, v := range runtime.ServiceStates {
+		var labels prometheus.Labels
+		labels = make(map[string]string)
+		labels["service"] = v.ServiceName
+		labels["node"] = v.Name
+		labels["mgmt_ip"] = addresses[v.Name]
+		labels["cluster"] = o.clusterLabel()
+		up := 0.0
+		if v.State == "CLUSTER_ACTIVE" {
+			up = 1
+		}
+		if err = add(c.newMetrics("avi_controller_service_up", labels, up)); err != nil {
+			return
+		}
+	}
+	labels := prometheus.Labels{"cluster": o.clusterLabel()}
+	if err = add(c.newStateSet("avi_controller_cluster_state", labels, "state", clusterStates, runtime.ClusterState.State)); err != nil {
+		return
+	}
+	labels["cluster_uuid"] = runtime.NodeInfo.ClusterUUID
+	labels["leader"] = leader
+	err = add(c.newMetrics("avi_controller_cluster_info", labels, 1))
+	return
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// metricSet accumulates the const metrics built during one scrape, along with
+// the errors of the phases that failed. Phases run concurrently, so updates
+// are serialized. A series added twice is only kept once, since a registry
+// fails the whole gather on duplicates.
+type metricSet struct {
+	mtx        sync.Mutex
+	metrics    []prometheus.Metric
+	seen       map[string]bool
+	duplicates int
+	errs       []error
+}
+
+func (o *metricSet) add(m ...prometheus.Metric) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	if o.seen == nil {
+		o.seen = make(map[string]bool)
+	}
+	for _, v := range m {
+		id := seriesID(v)
+		if o.seen[id] {
+			o.duplicates++
+			continue
+		}
+		o.seen[id] = true
+		o.metrics = append(o.metrics, v)
+	}
+}
+
+// seriesID identifies a series by its descriptor and label values.
+func seriesID(m prometheus.Metric) string {
+	var b strings.Builder
+	b.WriteString(m.Desc().String())
+	var d dto.Metric
+	if err := m.Write(&d); err != nil {
+		return b.String()
+	}
+	for _, l := range d.Label {
+		b.WriteString("\xff" + l.GetName() + "=" + l.GetValue())
+	}
+	return b.String()
+}
+
+func (o *metricSet) fail(err error) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	o.errs = append(o.errs, err)
+}
+
+// newMetrics builds a const gauge or counter for every series the Avi metric
+// is exported as, ordering the label values the way each descriptor expects
+// them.
+func (o *catalog) newMetrics(name string, labels prometheus.Labels, value float64) (r []prometheus.Metric, err error) {
+	descs, ok := o.descs[name]
+	if !ok {
+		err = fmt.Errorf("unexpected metric %q", name)
+		return
+	}
+	valueType := prometheus.GaugeValue
+	if o.GaugeOptsMap[name].MetricType == "counter" || stateCounters[name] {
+		valueType = prometheus.CounterValue
+	}
+	for _, d := range descs {
+		values := make([]string, len(d.labels))
+		for k, v := range d.labels {
+			values[k] = labels[v]
+		}
+		metric, err := prometheus.NewConstMetric(d.desc, valueType, value*d.scale, values...)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, metric)
+	}
+	return
+}
+
+// addSeries adds the metrics an Avi series is exported as to m. Series of
+// metrics missing from the catalog are skipped.
+func (o *Exporter) addSeries(c *catalog, m *metricSet, name string, labels prometheus.Labels, value float64) {
+	metrics, err := c.newMetrics(name, labels, value)
+	if err != nil {
+		o.skip("metric", err.Error())
+		return
+	}
+	m.add(metrics...)
+}
+
+// Describe implements prometheus.Collector.
+func (o *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	for _, descs := range o.currentCatalog().descs {
+		for _, v := range descs {
+			ch <- v.desc
+		}
+	}
+}
+
+// Collect implements prometheus.Collector by sending the metrics of the last
+// completed scrape. Objects that no longer exist in Avi are not part of it,
+// and neither are metrics removed from the catalog since.
+func (o *Exporter) Collect(ch chan<- prometheus.Metric) {
+	c := o.currentCatalog()
+	o.metricsMtx.RLock()
+	defer o.metricsMtx.RUnlock()
+	for _, v := range o.metrics {
+		if c.describes(v.Desc()) {
+			ch <- v
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// envPattern matches the ${VAR} references expanded in the config file. Bare
+// $VAR is left alone so that passwords may contain dollar signs.
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// escapeJSON escapes s for use inside a JSON string, so that values with
+// quotes or backslashes do not break the config file.
+func escapeJSON(s string) []byte {
+	b, _ := json.Marshal(s)
+	return b[1 : len(b)-1]
+}
+
+// defaultConfig returns the settings used for anything the config file and
+// the environment leave out.
+func defaultConfig() (r Config) {
+	r.Web = WebConfig{ListenAddress: ":8080", TelemetryPath: "/metrics"}
+	r.Metrics.Files = map[string]string{
+		"virtualservice": "lib/virtualservice_metrics.json",
+		"serviceengine":  "lib/serviceengine_metrics.json",
+		"controller":     "lib/controller_metrics.json",
+		"pool":           "lib/pool_metrics.json",
+		"server":         "lib/server_metrics.json",
+	}
+	r.Metrics.Naming.Namespaces = map[string]string{
+		"virtualservice": "avi_virtualservice",
+		"serviceengine":  "avi_serviceengine",
+		"controller":     "avi_controller",
+		"pool":           "avi_pool",
+		"server":         "avi_server",
+	}
+	r.Collectors.PoolMembers = true
+	r.Collectors.VirtualServices = true
+	r.Collectors.ServiceEngines = true
+	r.Collectors.SEGroups = true
+	r.Collectors.Cluster = true
+	r.Collectors.Certificates = true
+	r.Collectors.Alerts = true
+	r.Collectors.Events = true
+	r.Labels.ReverseDNS = true
+	r.Collect = CollectConfig{
+		Interval:           30 * time.Second,
+		Concurrency:        4,
+		Timeout:            60 * time.Second,
+		PoolMemberInterval: time.Minute,
+		InventoryTTL:       5 * time.Minute,
+		DiscoveryInterval:  time.Hour,
+	}
+	return
+}
+
+// loadConfig reads the config file on top of the defaults, then fills the
+// connection settings it leaves empty from the AVI_* environment variables.
+// An empty path only applies the defaults and the environment.
+func loadConfig(path string) (r Config, err error) {
+	r = defaultConfig()
+	if path != "" {
+		var b []byte
+		if b, err = ioutil.ReadFile(path); err != nil {
+			return
+		}
+		b = envPattern.ReplaceAllFunc(b, func(m []byte) []byte {
+			return escapeJSON(os.Getenv(string(envPattern.FindSubmatch(m)[1])))
+		})
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if err = dec.Decode(&r); err != nil {
+			err = fmt.Errorf("parsing %s: %v", path, err)
+			return
+		}
+	}
+	r.applyEnv()
+	err = r.validate()
+	return
+}
+
+// applyEnv keeps the environment variables used before the config file
+// existed working.
+func (o *Config) applyEnv() {
+	setFromEnv := func(v *string, key string) {
+		if *v == "" {
+			*v = os.Getenv(key)
+		}
+	}
+	setFromEnv(&o.Avi.Cluster, "AVI_CLUSTER")
+	setFromEnv(&o.Avi.Username, "AVI_USERNAME")
+	setFromEnv(&o.Avi.Password, "AVI_PASSWORD")
+	setFromEnv(&o.Avi.Tenant, "AVI_TENANT")
+	setFromEnv(&o.Avi.APIVersion, "AVI_APIVERSION")
+	if len(o.Metrics.Include) == 0 && os.Getenv("AVI_METRICS") != "" {
+		o.Metrics.Include = strings.Split(os.Getenv("AVI_METRICS"), ",")
+	}
+}
+
+func (o *Config) validate() (err error) {
+	if !strings.HasPrefix(o.Web.TelemetryPath, "/") {
+		return fmt.Errorf("web.telemetry_path must start with /: %q", o.Web.TelemetryPath)
+	}
+	for k, v := range o.Metrics.Files {
+		if _, ok := customLabels[k]; !ok {
+			return fmt.Errorf("metrics.files: unknown entity type %q", k)
+		}
+		if v == "" {
+			return fmt.Errorf("metrics.files: empty path for %s", k)
+		}
+	}
+	if o.Collect.Concurrency < 1 {
+		return fmt.Errorf("collect.concurrency must be at least 1: %d", o.Collect.Concurrency)
+	}
+	if o.Collect.Timeout <= 0 {
+		return fmt.Errorf("collect.timeout must be positive: %v", o.Collect.Timeout)
+	}
+	if o.Collect.Discovery && o.Collect.DiscoveryInterval <= 0 {
+		return fmt.Errorf("metrics.discovery-interval must be positive: %v", o.Collect.DiscoveryInterval)
+	}
+	if t := o.Avi.TLS; t.InsecureSkipVerify != nil && *t.InsecureSkipVerify && (t.CAFile != "" || t.ServerName != "") {
+		return fmt.Errorf("avi.tls: ca_file and server_name have no effect with insecure_skip_verify")
+	}
+	if o.Avi.TLS.CAFile != "" {
+		if _, err = ioutil.ReadFile(o.Avi.TLS.CAFile); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// insecure reports whether the controller certificate goes unverified.
+func (o TLSConfig) insecure() bool {
+	if o.InsecureSkipVerify != nil {
+		return *o.InsecureSkipVerify
+	}
+	return o.CAFile == "" && o.ServerName == ""
+}
+
+// transport returns the HTTP transport used to reach the controller.
+func (o TLSConfig) transport() (r *http.Transport, err error) {
+	c := &tls.Config{InsecureSkipVerify: o.insecure(), ServerName: o.ServerName}
+	if o.CAFile != "" {
+		var pem []byte
+		if pem, err = ioutil.ReadFile(o.CAFile); err != nil {
+			return
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			err = fmt.Errorf("no certificates found in %s", o.CAFile)
+			return
+		}
+	}
+	r = &http.Transport{TLSClientConfig: c}
+	return
+}
+
+// clusterURL returns the cluster as a URL, since AVI_CLUSTER is usually a
+// bare host name.
+func (o AviConfig) clusterURL() string {
+	if strings.Contains(o.Cluster, "://") {
+		return o.Cluster
+	}
+	return "https://" + o.Cluster
+}
+
+// clusterAddress returns the host and port of the cluster, for dialing it.
+func (o AviConfig) clusterAddress() (r string, err error) {
+	u, err := url.Parse(o.clusterURL())
+	if err != nil {
+		return
+	}
+	port := u.Port()
+	if port == "" {
+		if u.Scheme == "https" {
+			port = "443"
+		} else {
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigEscapesEnv(t *testing.T) {
+	tests := []string{
+		"plain",
+		`with "quotes"`,
+		`back\slash`,
+		"new\nline",
+		"dollar $AVI and ${NOT_SET}",
+	}
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	if err = ioutil.WriteFile(path, []byte(`{"avi": {"password": "${TEST_AVI_PASSWORD}"}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("TEST_AVI_PASSWORD")
+	for _, password := range tests {
+		os.Setenv("TEST_AVI_PASSWORD", password)
+		c, err := loadConfig(path)
+		if err != nil {
+			t.Errorf("%q: %v", password, err)
+			continue
+		}
+		if c.Avi.Password != password {
+			t.Errorf("password = %q, want %q", c.Avi.Password, password)
+		}
+	}
+}
+
+func TestTargetConfigClusterLabel(t *testing.T) {
+	c := defaultConfig()
+	c.Avi.Cluster = "default.example.com"
+	c.Labels.Cluster = "default"
+	for _, target := range []string{"a.example.com", "b.example.com"} {
+		o := new(Exporter)
+		o.config.Store(targetConfig(c, target, TargetConfig{}))
+		if got := o.clusterLabel(); got != target {
+			t.Errorf("cluster label = %q, want %q", got, target)
+		}
+	}
+}
+
+func TestConfigTLS(t *testing.T) {
+	tests := []struct {
+		name     string
+		tls      string
+		insecure bool
+		valid    bool
+	}{
+		{"default", `{}`, true, true},
+		{"server name", `{"server_name": "avi.example.com"}`, false, true},
+		{"verified", `{"insecure_skip_verify": false}`, false, true},
+		{"insecure", `{"insecure_skip_verify": true}`, true, true},
+		{"insecure with server name", `{"insecure_skip_verify": true, "server_name": "avi.example.com"}`, true, false},
+	}
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ioutil.WriteFile(path, []byte(`{"avi": {"tls": `+tt.tls+`}}`), 0600); err != nil {
+				t.Fatal(err)
+			}
+			c, err := loadConfig(path)
+			if (err == nil) != tt.valid {
+				t.Fatalf("err = %v, want valid %v", err, tt.valid)
+			}
+			if got := c.Avi.TLS.insecure(); tt.valid && got != tt.insecure {
+				t.Errorf("insecure = %v, want %v", got, tt.insecure)
+			}
+		})
+	}
+}
+
+func TestClusterAddress(t *testing.T) {
+	tests := []struct {
+		cluster string
+		address string
+	}{
+		{"avi.example.com", "avi.example.com:443"},
+		{"http://avi.example.com", "avi.example.com:80"},
+		{"avi.example.com:8443", "avi.example.com:8443"},
+		{"[2001:db8::1]", "[2001:db8::1]:443"},
+		{"https://[2001:db8::1]:8443", "[2001:db8::1]:8443"},
+	}
+	for _, tt := range tests {
+		got, err := AviConfig{Cluster: tt.cluster}.clusterAddress()
+		if err != nil || got != tt.address {
+			t.Errorf("%s: address = %q, %v, want %q", tt.cluster, got, err, tt.address)
+		}
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		edit  func(c *Config)
+		valid bool
+	}{
+		{"default", func(c *Config) {}, true},
+		{"no concurrency", func(c *Config) { c.Collect.Concurrency = 0 }, false},
+		{"no timeout", func(c *Config) { c.Collect.Timeout = 0 }, false},
+		{"missing metric file", func(c *Config) { c.Metrics.Files["pool"] = "lib/missing.json" }, true},
+		{"missing required metric file", func(c *Config) { c.Metrics.Files["virtualservice"] = "lib/missing.json" }, false},
+		{"missing metric file with discovery", func(c *Config) {
+			c.Metrics.Files["virtualservice"] = "lib/missing.json"
+			c.Collect.Discovery = true
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := defaultConfig()
+			tt.edit(&c)
+			err := new(Exporter).checkConfig(c)
+			if (err == nil) != tt.valid {
+				t.Errorf("err = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
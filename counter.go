@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// counterRetention is how long the total of a counter series is kept after
+// its entity was last seen.
+const counterRetention = time.Hour
+
+// scrapeInterval is the collection interval assumed when the exporter
+// collects on every scrape.
+const scrapeInterval = time.Minute
+
+// counterLimit returns the number of data points that cover two collection
+// intervals at the given step, so that a failed collection loses nothing.
+func counterLimit(interval time.Duration, step int) int {
+	if interval <= 0 {
+		interval = scrapeInterval
+	}
+	period := time.Duration(step) * time.Second
+	return 2 * int((interval+period-1)/period)
+}
+
+// counterSeries is the running total of one counter series.
+type counterSeries struct {
+	total float64
+	last  time.Time
+	seen  time.Time
+}
+
+// counterStore accumulates the per-interval sums Avi returns for counter
+// metrics into monotonically increasing totals. Data points are deduplicated
+// by timestamp, so overlapping responses from consecutive collections are
+// only counted once.
+type counterStore struct {
+	mtx    sync.Mutex
+	series map[string]*counterSeries
+}
+
+func newCounterStore() (r *counterStore) {
+	r = new(counterStore)
+	r.series = make(map[string]*counterSeries)
+	return
+}
+
+// add adds the data points newer than the last one counted for the series and
+// returns its total. The data points of a new series only mark where counting
+// starts, so totals start at zero. ok is false when the series was never seen
+// with data points.
+func (o *counterStore) add(v CollectionResponse) (r float64, ok bool) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	key := v.Header.Name + "/" + v.Header.EntityUUID + "/" + v.Header.PoolUUID + "/" + v.Header.ObjID
+	s, found := o.series[key]
+	if !found {
+		if len(v.Data) == 0 {
+			return
+		}
+		s = new(counterSeries)
+		o.series[key] = s
+	}
+	data := v.Data
+	sort.Slice(data, func(i, j int) bool { return data[i].Timestamp.Before(data[j].Timestamp) })
+	for _, d := range data {
+		if !d.Timestamp.After(s.last) {
+			continue
+		}
+		if found {
+			s.total += d.Value
+		}
+		s.last = d.Timestamp
+	}
+	s.seen = time.Now()
+	return s.total, true
+}
+
+// prune forgets the series that were not seen for counterRetention.
+func (o *counterStore) prune() {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	for k, v := range o.series {
+		if time.Since(v.seen) > counterRetention {
+			delete(o.series, k)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCounterStoreAdd(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+		total   float64
+	}{
+		{"first sight", `{"header":{"name":"l4_client.sum_conns","entity_uuid":"vs-1"},"data":[{"timestamp":"2026-01-01T00:00:00Z","value":5},{"timestamp":"2026-01-01T00:00:05Z","value":7}]}`, 0},
+		{"overlap", `{"header":{"name":"l4_client.sum_conns","entity_uuid":"vs-1"},"data":[{"timestamp":"2026-01-01T00:00:05Z","value":7},{"timestamp":"2026-01-01T00:00:10Z","value":3}]}`, 3},
+		{"gap", `{"header":{"name":"l4_client.sum_conns","entity_uuid":"vs-1"},"data":[{"timestamp":"2026-01-01T00:00:20Z","value":2},{"timestamp":"2026-01-01T00:00:15Z","value":1}]}`, 6},
+		{"no new data", `{"header":{"name":"l4_client.sum_conns","entity_uuid":"vs-1"},"data":[]}`, 6},
+	}
+	s := newCounterStore()
+	for _, tt := range tests {
+		var v CollectionResponse
+		decodeFixture(t, tt.fixture, &v)
+		total, ok := s.add(v)
+		if !ok || total != tt.total {
+			t.Errorf("%s: total = %v, %v, want %v", tt.name, total, ok, tt.total)
+		}
+	}
+}
+
+func TestCounterLimit(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		step     int
+		limit    int
+	}{
+		{30 * time.Second, 5, 12},
+		{0, 5, 24},
+		{time.Minute, 300, 2},
+		{7 * time.Second, 5, 4},
+	}
+	for _, tt := range tests {
+		if got := counterLimit(tt.interval, tt.step); got != tt.limit {
+			t.Errorf("counterLimit(%v, %d) = %d, want %d", tt.interval, tt.step, got, tt.limit)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/avinetworks/sdk/go/clients"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// discoveryEntityTypes lists the entity types of the metrics-option catalog
+// the exporter collects, in order of preference. A metric id maps to a single
+// family, so ids shared by several entity types go to the first one listed.
+// Pool and server metrics are keyed apart, so ids of pools are also collected
+// per pool, and ids of servers per pool member.
+var discoveryEntityTypes = []string{"virtualservice", "serviceengine", "controller"}
+
+func (o *Exporter) fetchMetricList(ctx context.Context) (r MetricList, err error) {
+	err = o.withSession(ctx, func(c *clients.AviClient) error {
+		return c.AviSession.Get("api/analytics/metrics-option", &r)
+	})
+	return
+}
+
+// discoverMetrics builds gauge options for every metric id in the controller's
+// catalog. Definitions from the lib files take precedence, so that their help
+// text overrides Avi's description.
+func (o *Exporter) discoverMetrics(ctx context.Context) (r GaugeOptsMap, err error) {
+	list, err := o.fetchMetricList(ctx)
+	if err != nil {
+		return
+	}
+	o.storeUnits(list)
+	lib := o.currentLibMetrics()
+	all := make(GaugeOptsMap)
+	for id, v := range list.MetricsData {
+		var types []string
+		if entityType := discoveryEntityType(v.EntityTypes); entityType != "" {
+			types = append(types, entityType)
+		}
+		if hasEntityType(v.EntityTypes, "pool") {
+			types = append(types, "pool")
+		}
+		// Avi lists most server metrics under pools only, so the server
+		// metrics of the lib files are kept as well.
+		if _, ok := lib[metricKey("server", id)]; ok || hasEntityType(v.EntityTypes, "server") {
+			types = append(types, "server")
+		}
+		for _, entityType := range types {
+			key := metricKey(entityType, id)
+			if opts, ok := lib[key]; ok {
+				if opts.Units == "" {
+					opts.Units = v.MetricUnits
+				}
+				all[key] = opts
+				continue
+			}
+			fName := metricName(key, "")
+			all[key] = GaugeOpts{CustomLabels: customLabels[entityType], Type: entityType, MetricID: id, GaugeOpts: prometheus.GaugeOpts{Name: fName, Help: v.Description}, Units: v.MetricUnits}
+		}
+	}
+	r, missing := filterMetrics(o.currentConfig(), all)
+	if len(missing) > 0 {
+		log.Printf("selected metrics unknown to the controller: %s", strings.Join(missing, ","))
+	}
+	return
+}
+
+// discoveryEntityType returns the preferred family among the entity types.
+func discoveryEntityType(entityTypes []string) string {
+	for _, t := range discoveryEntityTypes {
+		if hasEntityType(entityTypes, t) {
+			return t
+		}
+	}
+	return ""
+}
+
+func hasEntityType(entityTypes []string, t string) bool {
+	for _, v := range entityTypes {
+		if strings.ToLower(v) == t {
+			return true
+		}
+	}
+	return false
+}
+
+// startDiscovery refreshes the metric catalog from the controller right away
+// and then on every interval. The lib files stay in use until the first
+// discovery succeeds.
+func (o *Exporter) startDiscovery(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			o.refreshCatalog()
+			select {
+			case <-ticker.C:
+			case <-o.done:
+				return
+			}
+		}
+	}()
+}
+
+func (o *Exporter) refreshCatalog() {
+	ctx, cancel := contextUntil(o.done, o.collectOpts.timeout)
+	defer cancel()
+	metrics, err := o.discoverMetrics(ctx)
+	if err != nil {
+		log.Printf("discovering metrics: %v", err)
+		return
+	}
+	naming := o.currentConfig().Metrics.Naming
+	if current := o.currentCatalog(); sameMetrics(metrics, current.GaugeOptsMap) && reflect.DeepEqual(naming, current.naming) {
+		return
+	}
+	if err = o.setCatalog(newCatalog(metrics, naming)); err != nil {
+		log.Printf("registering discovered metrics: %v", err)
+		return
+	}
+	log.Printf("discovered %d metrics", len(metrics))
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestDiscoverMetricsKeepsServerMetrics(t *testing.T) {
+	server, _ := newFakeAPI(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/analytics/metrics-option" {
+			w.Write([]byte(`{}`))
+			return
+		}
+		w.Write([]byte(`{"metrics_data": {
+			"l4_client.apdexc": {"entity_types": ["virtualservice"], "metric_units": "METRIC_COUNT", "description": "apdex"},
+			"l7_client.avg_resp_latency": {"entity_types": ["virtualservice", "pool"], "metric_units": "MILLISECONDS", "description": "latency"},
+			"l4_server.avg_total_rtt": {"entity_types": ["pool"], "metric_units": "MILLISECONDS", "description": "rtt"},
+			"l4_server.avg_bandwidth": {"entity_types": ["pool"], "metric_units": "BITS_PER_SECOND", "description": "bandwidth"}
+		}}`))
+	})
+	defer server.Close()
+	o := newSessionTestExporter(server, 1)
+	lib, _, err := o.setPromMetricsMap(o.currentConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(lib, "server.l4_server.avg_bandwidth")
+	o.libMetrics.Store(lib)
+	metrics, err := o.discoverMetrics(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"l4_client.apdexc", "pool.l7_client.avg_resp_latency", "server.l4_server.avg_total_rtt"} {
+		if _, ok := metrics[key]; !ok {
+			t.Errorf("%s was not discovered", key)
+		}
+	}
+	if _, ok := metrics["server.l4_server.avg_bandwidth"]; ok {
+		t.Error("server.l4_server.avg_bandwidth was discovered without a server definition")
+	}
+	if c := newCatalog(metrics, o.currentConfig().Metrics.Naming); !c.collects("server") {
+		t.Error("server metrics are not collected after discovery")
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/avinetworks/sdk/go/clients"
+	"github.com/avinetworks/sdk/go/session"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// eventPageSize is the number of events read per scrape. Events left over are
+// read by the next scrapes.
+const eventPageSize = 1000
+
+// eventTimeLayout is the layout the start of an event query is sent in.
+const eventTimeLayout = "2006-01-02T15:04:05.000000Z"
+
+// eventTimeLayouts lists the layouts Avi formats event timestamps in.
+var eventTimeLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999", "2006-01-02 15:04:05"}
+
+// eventLogger writes events as JSON lines, apart from the exporter logs.
+var eventLogger = log.New(os.Stdout, "", 0)
+
+// eventTime is the report timestamp of an event. Avi sends it either as a
+// date or as microseconds since the epoch.
+type eventTime struct {
+	time.Time
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (o *eventTime) UnmarshalJSON(b []byte) (err error) {
+	s := strings.Trim(string(b), `"`)
+	if s == "" || s == "null" {
+		return
+	}
+	if us, err := strconv.ParseInt(s, 10, 64); err == nil {
+		o.Time = time.Unix(0, us*int64(time.Microsecond)).UTC()
+		return nil
+	}
+	for _, layout := range eventTimeLayouts {
+		if o.Time, err = time.Parse(layout, s); err == nil {
+			return
+		}
+	}
+	return
+}
+
+// eventKey identifies an avi_events_total series.
+type eventKey struct {
+	eventID, module, objectType string
+}
+
+// eventStore counts the events read so far. Events are read from the
+// high-water mark on, the report timestamp of the last event counted; the
+// events at that timestamp are remembered as the next read returns them again.
+type eventStore struct {
+	mtx    sync.Mutex
+	mark   time.Time
+	seen   map[string]bool
+	totals map[eventKey]float64
+}
+
+func newEventStore() (r *eventStore) {
+	r = new(eventStore)
+	r.seen = make(map[string]bool)
+	r.totals = make(map[eventKey]float64)
+	return
+}
+
+// id identifies an event among the events with the same timestamp.
+func (o eventLog) id() string {
+	return o.EventID + "/" + o.ObjUUID + "/" + o.ReportTimestamp.Format(time.RFC3339Nano)
+}
+
+// fetchEvents retrieves the events reported from start on, oldest first. A
+// zero start retrieves the last event only.
+func (o *Exporter) fetchEvents(ctx context.Context, start time.Time) (r []eventLog, err error) {
+	params := map[string]string{
+		"type":      "2",
+		"page_size": strconv.Itoa(eventPageSize),
+		"orderby":   "report_timestamp",
+	}
+	if start.IsZero() {
+		params["page_size"] = "1"
+		params["orderby"] = "-report_timestamp"
+	} else {
+		params["start"] = start.UTC().Format(eventTimeLayout)
+	}
+	resp := new(eventLogs)
+	err = o.withSession(ctx, func(c *clients.AviClient) error {
+		return c.AviSession.Get("api/analytics/logs", resp, session.SetParams(params))
+	})
+	return resp.Results, err
+}
+
+// add counts the events not counted yet, moves the high-water mark and
+// returns the totals. The first call only sets the high-water mark, to the
+// last event or else to now, so the events reported before the exporter
+// started are not counted.
+func (o *eventStore) add(events []eventLog, first bool) (r map[eventKey]float64, added []eventLog) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	for _, v := range events {
+		t := v.ReportTimestamp.Time
+		if t.IsZero() || t.Before(o.mark) || o.seen[v.id()] {
+			continue
+		}
+		if t.After(o.mark) {
+			o.mark = t
+			o.seen = make(map[string]bool)
+		}
+		o.seen[v.id()] = true
+		if first {
+			continue
+		}
+		o.totals[eventKey{v.EventID, v.Module, v.ObjType}]++
+		added = append(added, v)
+	}
+	if first && o.mark.IsZero() {
+		o.mark = time.Now().UTC()
+	}
+	if len(events) == eventPageSize && len(added) == 0 && !first {
+		// A full page at a single timestamp; skip past it rather than
+		// reading it again forever.
+		log.Println("more than", eventPageSize, "events at", o.mark, "skipping the rest")
+		o.mark = o.mark.Add(time.Microsecond)
+		o.seen = make(map[string]bool)
+	}
+	r = make(map[eventKey]float64)
+	for k, v := range o.totals {
+		r[k] = v
+	}
+	return
+}
+
+// start returns the high-water mark.
+func (o *eventStore) start() time.Time {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	return o.mark
+}
+
+// logEvent writes an event as a JSON line on the standard output.
+func (o *Exporter) logEvent(v eventLog) {
+	bytes, err := json.Marshal(map[string]string{
+		"timestamp":   v.ReportTimestamp.Format(time.RFC3339Nano),
+		"cluster":     o.clusterLabel(),
+		"event_id":    v.EventID,
+		"module":      v.Module,
+		"object_type": v.ObjType,
+		"object_name": v.ObjName,
+		"object_uuid": v.ObjUUID,
+		"tenant":      v.Tenant,
+		"internal":    v.Internal,
+		"description": v.EventDescription,
+	})
+	if err != nil {
+		log.Println("cannot log event", v.EventID, err)
+		return
+	}
+	eventLogger.Println(string(bytes))
+}
+
+// setEventMetrics reads the events reported since the previous scrape and
+// reports the number of events per event id, module and object type. With
+// log_events, the events read are also written to the standard output.
+func (o *Exporter) setEventMetrics(s *scheduler, m *metricSet) (err error) {
+	config := o.currentConfig()
+	if !config.Collectors.Events {
+		return
+	}
+	c := o.currentCatalog()
+	start := o.events.start()
+	var events []eventLog
+	if err = s.fetch(func() (err error) { events, err = o.fetchEvents(s.ctx, start); return }); err != nil {
+		return
+	}
+	totals, added := o.events.add(events, start.IsZero())
+	if config.Collectors.LogEvents {
+		for _, v := range added {
+			o.logEvent(v)
+		}
+	}
+	for k, v := range totals {
+		var labels prometheus.Labels
+		labels = make(map[string]string)
+		labels["event_id"] = k.eventID
+		labels["module"] = k.module
+		labels["object_type"] = k.objectType
+		labels["cluster"] = o.clusterLabel()
+		metrics, err := c.newMetrics("avi_events_total", labels, v)
+		if err != nil {
+			return err
+		}
+		m.add(metrics...)
+	}
+	return
+}
@@ -1,16 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/avinetworks/sdk/go/clients"
+	"github.com/avinetworks/sdk/go/models"
 	"github.com/avinetworks/sdk/go/session"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/tidwall/pretty"
@@ -21,6 +28,27 @@ func formatAviRef(in string) string {
 	return uriArr[len(uriArr)-1]
 }
 
+// refName returns the name of the object a ref fetched with include_name
+// points to, or its uuid when the ref has no name.
+func refName(in string) string {
+	if i := strings.LastIndex(in, "#"); i >= 0 {
+		return in[i+1:]
+	}
+	return formatAviRef(in)
+}
+
+// refUUID returns the uuid of the object a ref points to, with or without
+// include_name.
+func refUUID(in string) string {
+	return formatAviRef(strings.SplitN(in, "#", 2)[0])
+}
+
+// pageSize is the number of objects asked for per page by fetchPages.
+const pageSize = 200
+
+// includeName makes Avi append the name of the referenced object to refs.
+var includeName = session.SetParams(map[string]string{"include_name": "true"})
+
 func fromJSONFile(path string, ob interface{}) (err error) {
 	toReturn := ob
 	openedFile, err := os.Open(path)
@@ -42,121 +70,217 @@ func fromJSONFile(path string, ob interface{}) (err error) {
 	return
 }
 
-func (o *Exporter) getDefaultMetrics(entityType string) (r DefaultMetrics, err error) {
-	var path string
+func (o *Exporter) getDefaultMetrics(c Config, entityType string) (r DefaultMetrics, err error) {
 	r = DefaultMetrics{}
-	switch entityType {
-	case "virtualservice":
-		path = "lib/virtualservice_metrics.json"
-	case "serviceengine":
-		path = "lib/serviceengine_metrics.json"
-	case "controller":
-		path = "lib/controller_metrics.json"
-	default:
-		err = errors.New("entity type must be either: virtualserver, servicengine or controller")
-		log.Panic(err)
+	path, ok := c.Metrics.Files[entityType]
+	if !ok {
+		err = fmt.Errorf("no metric definitions configured for %s", entityType)
+		return
 	}
-
 	err = fromJSONFile(path, &r)
-	if err != nil {
-		log.Panic(err)
-	}
 	return
 }
 
-func (o *Exporter) setAllMetricsMap() (r GaugeOptsMap) {
+func (o *Exporter) setAllMetricsMap(c Config) (r GaugeOptsMap, err error) {
 	r = make(GaugeOptsMap)
-	//////////////////////////////////////////////////////////////////////////////
-	// Get default metrics.
-	//////////////////////////////////////////////////////////////////////////////
-	vsDefaultMetrics, err := o.getDefaultMetrics("virtualservice")
-	if err != nil {
-		log.Panic(err)
-	}
-	seDefaultMetrics, err := o.getDefaultMetrics("serviceengine")
-	if err != nil {
-		log.Panic(err)
+	for _, entityType := range entityTypes {
+		//////////////////////////////////////////////////////////////////////////
+		// Get default metrics.
+		//////////////////////////////////////////////////////////////////////////
+		defaultMetrics, err := o.getDefaultMetrics(c, entityType)
+		if os.IsNotExist(err) && optionalEntityTypes[entityType] {
+			continue
+		}
+		if err != nil {
+			return r, err
+		}
+		//////////////////////////////////////////////////////////////////////////
+		// Populating default metrics.
+		//////////////////////////////////////////////////////////////////////////
+		for _, v := range defaultMetrics {
+			if err = checkMetricSettings(v.Metric, v.MetricType, v.Step, v.Limit, v.Reduction); err != nil {
+				return r, err
+			}
+			key := metricKey(entityType, v.Metric)
+			fName := metricName(key, v.MetricType)
+			r[key] = GaugeOpts{CustomLabels: customLabels[entityType], Type: entityType, MetricID: v.Metric, GaugeOpts: prometheus.GaugeOpts{Name: fName, Help: v.Help},
+				MetricType: v.MetricType, Units: v.Units, Step: v.Step, Limit: v.Limit, MetricEntity: v.MetricEntity, Reduction: v.Reduction}
+		}
 	}
-	controllerDefaultMetrics, err := o.getDefaultMetrics("controller")
+	return
+}
+
+// setPromMetricsMap loads the metric definitions of c. It returns every
+// definition from the metric files and the ones selected for export.
+func (o *Exporter) setPromMetricsMap(c Config) (all GaugeOptsMap, r GaugeOptsMap, err error) {
+	all, err = o.setAllMetricsMap(c)
 	if err != nil {
-		log.Panic(err)
-	}
-	//////////////////////////////////////////////////////////////////////////////
-	// Populating default metrics. Leaving these as separate functions
-	// in the event we want different GaugeOpts in the future.
-	//////////////////////////////////////////////////////////////////////////////
-	for _, v := range vsDefaultMetrics {
-		fName := strings.ReplaceAll(v.Metric, ".", "_")
-		r[v.Metric] = GaugeOpts{CustomLabels: []string{"name", "fqdn", "ipaddress", "pool", "tenant_uuid", "units", "cluster"}, Type: "virtualservice", GaugeOpts: prometheus.GaugeOpts{Name: fName, Help: v.Help}}
-	}
-	for _, v := range seDefaultMetrics {
-		fName := strings.ReplaceAll(v.Metric, ".", "_")
-		r[v.Metric] = GaugeOpts{CustomLabels: []string{"name", "entity_uuid", "fqdn", "ipaddress", "tenant_uuid", "units", "cluster"}, Type: "serviceengine", GaugeOpts: prometheus.GaugeOpts{Name: fName, Help: v.Help}}
+		return
 	}
-	for _, v := range controllerDefaultMetrics {
-		fName := strings.ReplaceAll(v.Metric, ".", "_")
-		r[v.Metric] = GaugeOpts{CustomLabels: []string{"name", "entity_uuid", "fqdn", "ipaddress", "tenant_uuid", "units", "cluster"}, Type: "controller", GaugeOpts: prometheus.GaugeOpts{Name: fName, Help: v.Help}}
+	fillUnits(all, o.currentUnits())
+	r, missing := filterMetrics(c, all)
+	if len(missing) > 0 {
+		err = fmt.Errorf("unknown metrics selected: %s", strings.Join(missing, ","))
 	}
-	//////////////////////////////////////////////////////////////////////////////
 	return
 }
 
-func (o *Exporter) setPromMetricsMap() (r GaugeOptsMap) {
-	r = make(GaugeOptsMap)
-	all := o.setAllMetricsMap()
-	if o.userMetricString == "" {
+// filterMetrics keeps the user provided metrics, or all of them when the user
+// did not provide any. It also returns the user metrics that are unknown.
+func filterMetrics(c Config, all GaugeOptsMap) (r GaugeOptsMap, missing []string) {
+	if len(c.Metrics.Include) == 0 {
 		r = all
 		return
 	}
 	/////////////////////////////////////////////////////////
 	// User provided metrics list
 	/////////////////////////////////////////////////////////
-	metrics := strings.Split(o.userMetricString, ",")
-	for _, v := range metrics {
-		r[v] = all[v]
+	r = make(GaugeOptsMap)
+	for _, v := range c.Metrics.Include {
+		found := false
+		for k, opts := range all {
+			if k == v || opts.MetricID == v {
+				r[k] = opts
+				found = true
+			}
+		}
+		if !found {
+			missing = append(missing, v)
+		}
 	}
 	return
 }
-func (o *Exporter) setUserMetrics() (r string) {
-	r = os.Getenv("AVI_METRICS")
-	return
-}
 
 // NewExporter constructor.
-func NewExporter() (r *Exporter) {
+func NewExporter(c Config) (r *Exporter, err error) {
 	r = new(Exporter)
-	r.userMetricString = r.setUserMetrics()
-	r.connectionOpts = r.setConnectionOpts()
-	r.GaugeOptsMap = r.setPromMetricsMap()
+	r.config.Store(c)
+	err = r.init()
 	return
 }
 
-func (o *Exporter) setConnectionOpts() (r connectionOpts) {
-	r.username = os.Getenv("AVI_USERNAME")
-	r.password = os.Getenv("AVI_PASSWORD")
-	r.cluster = os.Getenv("AVI_CLUSTER")
-	r.tenant = os.Getenv("AVI_TENANT")
-	r.apiVersion = os.Getenv("AVI_APIVERSION")
+// newTargetExporter creates an exporter for a single probe target using the
+// connection settings from the targets file and everything else from c.
+func newTargetExporter(c Config, target string, t TargetConfig) (r *Exporter, err error) {
+	return NewExporter(targetConfig(c, target, t))
+}
+
+// targetConfig returns c with the connection settings of a probe target. The
+// cluster label of c names the default cluster, so targets are labelled with
+// their own address instead. Targets are collected on every probe rather
+// than on an interval.
+func targetConfig(c Config, target string, t TargetConfig) Config {
+	c.Avi.Cluster = target
+	c.Labels.Cluster = ""
+	c.Collect.Interval = 0
+	c.Avi.Username = t.Username
+	c.Avi.Password = t.Password
+	c.Avi.Tenant = t.Tenant
+	c.Avi.APIVersion = t.APIVersion
+	return c
+}
+
+// init sets the metric definitions and registers the exporter on a registry
+// owned by the exporter. In discovery mode, metrics missing from the lib files
+// are not an error since the controller's catalog may provide them.
+func (o *Exporter) init() (err error) {
+	o.done = make(chan struct{})
+	c := o.currentConfig().Collect
+	o.collectOpts = collectOpts{interval: c.Interval, concurrency: c.Concurrency, timeout: c.Timeout, poolMemberInterval: c.PoolMemberInterval}
+	lib, metrics, err := o.setPromMetricsMap(o.currentConfig())
+	if err != nil && !c.Discovery {
+		return
+	}
+	err = nil
+	o.libMetrics.Store(lib)
+	o.lastSuccess = newLastSuccessGauge()
+	o.relogins = newReloginsCounter()
+	o.sessions = newSessionPool(o.collectOpts.concurrency)
+	o.phaseMetrics = newPhaseMetrics()
+	o.malformed = newMalformedCounter()
+	o.counters = newCounterStore()
+	o.alerts = newAlertStore()
+	o.events = newEventStore()
+	o.inventoryOpts = inventoryOpts{ttl: c.InventoryTTL, incremental: c.InventoryIncremental}
+	m := newInventoryMetrics()
+	o.inventory = o.newInventory(m)
+	o.selfCollectors = []prometheus.Collector{
+		o.lastSuccess, o.relogins, o.malformed,
+		o.phaseMetrics.up, o.phaseMetrics.errors, o.phaseMetrics.duration,
+		m.hits, m.misses, m.refreshDuration,
+	}
+	if err = o.setCatalog(newCatalog(metrics, o.currentConfig().Metrics.Naming)); err != nil {
+		return
+	}
+	o.inventory.start(o.inventoryOpts.ttl, o.collectOpts.timeout, o.done)
+	o.startPoolMemberPoller(o.collectOpts.poolMemberInterval)
+	if c.Discovery {
+		o.startDiscovery(c.DiscoveryInterval)
+	} else if o.currentConfig().Metrics.Naming.Conformant {
+		o.startUnitLookup(time.Minute)
+	}
 	return
 }
 
-// connect establishes the avi connection.
-func (o *Exporter) connect() (r *clients.AviClient, err error) {
-	// simplify avi connection
-	r, err = clients.NewAviClient(o.connectionOpts.cluster, o.connectionOpts.username,
-		session.SetPassword(o.connectionOpts.password),
-		session.SetTenant(o.connectionOpts.tenant),
-		session.SetInsecure,
-		session.SetVersion(o.connectionOpts.apiVersion))
+// currentConfig returns the configuration in use, which changes on reload.
+func (o *Exporter) currentConfig() Config {
+	return o.config.Load().(Config)
+}
+
+func (o *Exporter) currentLibMetrics() GaugeOptsMap {
+	r, _ := o.libMetrics.Load().(GaugeOptsMap)
+	return r
+}
+
+// clusterLabel returns the value of the cluster label.
+func (o *Exporter) clusterLabel() string {
+	c := o.currentConfig()
+	if c.Labels.Cluster != "" {
+		return c.Labels.Cluster
+	}
+	return c.Avi.Cluster
+}
+
+func newConnectionOpts(c AviConfig) (r connectionOpts) {
+	r.username = c.Username
+	r.password = c.Password
+	r.cluster = c.Cluster
+	if u, err := url.Parse(c.clusterURL()); err == nil && u.Host != "" {
+		r.host = u.Host
+	}
+	r.tenant = c.Tenant
+	r.apiVersion = c.APIVersion
 	return
 }
-func (o *Exporter) registerGauges() {
-	o.guages = make(map[string]*prometheus.GaugeVec)
-	for k, v := range o.GaugeOptsMap {
-		g := prometheus.NewGaugeVec(v.GaugeOpts, v.CustomLabels)
-		prometheus.MustRegister(g)
-		o.guages[k] = g
+
+// connect establishes a new avi connection. Callers should go through
+// withSession so that the session is reused across collections. Without a
+// configured API version, the version of the controller is used.
+func (o *Exporter) connect(s *pooledSession) (r *clients.AviClient, err error) {
+	c := o.currentConfig()
+	transport, err := c.Avi.TLS.transport()
+	if err != nil {
+		return
+	}
+	opts := newConnectionOpts(c.Avi)
+	// simplify avi connection
+	r, err = clients.NewAviClient(opts.host, opts.username,
+		session.SetPassword(opts.password),
+		session.SetTenant(opts.tenant),
+		session.SetTransport(s.transport(transport, o.relogins)),
+		session.SetTimeout(o.collectOpts.timeout),
+		session.SetVersion(opts.apiVersion))
+	if err != nil || opts.apiVersion != "" {
+		return
+	}
+	version, err := detectVersion(r)
+	if err != nil {
+		log.Printf("detecting controller version, using the default API version: %v", err)
+		return r, nil
 	}
+	log.Printf("using API version %s", version)
+	err = session.SetVersion(version)(r.AviSession)
+	return
 }
 
 // sortUniqueKeys sorts unique keys within a string array.
@@ -174,273 +298,597 @@ func sortUniqueKeys(in []string) ([]string, error) {
 	return resp, err
 }
 
-func (o *Exporter) getVirtualServices() (r map[string]virtualServiceDef, err error) {
-	vs, err := o.AviClient.VirtualService.GetAll()
-	var pooluuid string
-
+// fetchVirtualServices retrieves every virtual service from Avi.
+func (o *Exporter) fetchVirtualServices(ctx context.Context) (r map[string]virtualServiceDef, err error) {
+	var vs []*models.VirtualService
+	err = o.withSession(ctx, func(c *clients.AviClient) (err error) {
+		vs, err = c.VirtualService.GetAll()
+		return
+	})
 	if err != nil {
-		log.Panic(err)
+		return
 	}
 	r = make(map[string]virtualServiceDef)
 	for _, v := range vs {
-		vip := v.Vip[0]
-		address := *vip.IPAddress.Addr
-		dns, _ := net.LookupAddr(address)
-		for k, v := range dns {
-			dns[k] = strings.TrimSuffix(v, ".")
+		if def, ok := o.newVirtualServiceDef(v); ok {
+			r[*v.UUID] = def
 		}
+	}
+	return
+}
 
-		dns, err = sortUniqueKeys(dns)
-
-		if v.PoolRef != nil {
-			pooluuid = formatAviRef(*v.PoolRef)
-		}
+// newVirtualServiceDef maps a virtual service, resolving its VIP in DNS.
+// Virtual services without uuid or name are skipped; those without an inline
+// VIP are kept without an address.
+func (o *Exporter) newVirtualServiceDef(v *models.VirtualService) (r virtualServiceDef, ok bool) {
+	if v == nil || v.UUID == nil || v.Name == nil {
+		o.skip("virtualservice", "missing uuid or name")
+		return
+	}
+	r = virtualServiceDef{Name: *v.Name}
+	if v.TenantRef != nil {
+		r.TenantUUID = formatAviRef(*v.TenantRef)
+	}
+	if address, found := vsAddress(v); found {
+		r.IPAddress = address
+		r.FQDN = o.reverseDNS(address)
+	} else {
+		o.skip("virtualservice", "no inline VIP on "+*v.Name)
+	}
+	if v.PoolRef != nil {
+		r.PoolUUID = formatAviRef(*v.PoolRef)
+	}
+	if v.PoolGroupRef != nil {
+		r.PoolGroupUUID = formatAviRef(*v.PoolGroupRef)
+	}
+	if v.SeGroupRef != nil {
+		r.SEGroupUUID = formatAviRef(*v.SeGroupRef)
+	}
+	for _, ref := range v.SslKeyAndCertificateRefs {
+		r.CertUUIDs = append(r.CertUUIDs, formatAviRef(ref))
+	}
+	if v.LastModified != nil {
+		r.LastModified = *v.LastModified
+	}
+	return r, true
+}
 
-		r[*v.UUID] = virtualServiceDef{Name: *v.Name, IPAddress: address, FQDN: strings.Join(dns, ","), PoolUUID: pooluuid}
+// reverseDNS returns the sorted, unique names the address resolves to, or
+// nothing when reverse lookups are disabled.
+func (o *Exporter) reverseDNS(address string) string {
+	if !o.currentConfig().Labels.ReverseDNS {
+		return ""
 	}
-	return
+	dns, _ := net.LookupAddr(address)
+	for k, v := range dns {
+		dns[k] = strings.TrimSuffix(v, ".")
+	}
+	dns, _ = sortUniqueKeys(dns)
+	return strings.Join(dns, ",")
 }
 
-func (o *Exporter) getClusterRuntime() (r map[string]clusterDef, err error) {
+// fetchClusterRuntime retrieves the controller nodes from Avi.
+func (o *Exporter) fetchClusterRuntime(ctx context.Context) (r map[string]clusterDef, err error) {
 	resp := new(cluster)
-	err = o.AviClient.AviSession.Get("/api/cluster", &resp)
+	err = o.withSession(ctx, func(c *clients.AviClient) error {
+		return c.AviSession.Get("/api/cluster", &resp)
+	})
 
 	if err != nil {
-		log.Panic(err)
+		return
 	}
 	r = make(map[string]clusterDef)
 	for _, v := range resp.Nodes {
+		if v.VMUUID == "" {
+			o.skip("cluster_node", "missing vm_uuid on "+v.Name)
+			continue
+		}
 		address := v.IP.Addr
-		dns, _ := net.LookupAddr(address)
-		r[v.VMUUID] = clusterDef{Name: v.Name, IPAddress: address, FQDN: strings.Join(dns, ",")}
+		var fqdn string
+		if address != "" {
+			fqdn = o.reverseDNS(address)
+		}
+		r[v.VMUUID] = clusterDef{Name: v.Name, IPAddress: address, FQDN: fqdn}
 	}
 	return
 }
 
-func (o *Exporter) getServiceEngines() (r map[string]seDef, err error) {
-	se, err := o.AviClient.ServiceEngine.GetAll()
+// fetchServiceEngines retrieves every service engine from Avi.
+func (o *Exporter) fetchServiceEngines(ctx context.Context) (r map[string]seDef, err error) {
+	var se []*models.ServiceEngine
+	err = o.withSession(ctx, func(c *clients.AviClient) (err error) {
+		se, err = c.ServiceEngine.GetAll(includeName)
+		return
+	})
 	if err != nil {
-		log.Panic(err)
+		return
 	}
 	r = make(map[string]seDef)
 	for _, v := range se {
-		address := *v.MgmtVnic.VnicNetworks[0].IP.IPAddr.Addr
-		dns, _ := net.LookupAddr(address)
-		for k, v := range dns {
-			dns[k] = strings.TrimSuffix(v, ".")
+		if def, ok := o.newSeDef(v); ok {
+			r[*v.UUID] = def
 		}
-		r[*v.UUID] = seDef{Name: *v.Name, IPAddress: address, FQDN: strings.Join(dns, ",")}
 	}
 	return
 }
 
-func (o *Exporter) getPools() (r map[string]poolDef, err error) {
-	vs, err := o.AviClient.Pool.GetAll()
+// newSeDef maps a service engine, resolving its management address in DNS.
+// Service engines without a management address yet are kept without one. The
+// service engine must be fetched with include_name for its group and cloud to
+// be named.
+func (o *Exporter) newSeDef(v *models.ServiceEngine) (r seDef, ok bool) {
+	if v == nil || v.UUID == nil || v.Name == nil {
+		o.skip("serviceengine", "missing uuid or name")
+		return
+	}
+	r = seDef{Name: *v.Name}
+	if address, found := seAddress(v); found {
+		r.IPAddress = address
+		r.FQDN = o.reverseDNS(address)
+	} else {
+		o.skip("serviceengine", "no management address on "+*v.Name)
+	}
+	if v.SeGroupRef != nil {
+		r.SEGroup = refName(*v.SeGroupRef)
+		r.SEGroupUUID = refUUID(*v.SeGroupRef)
+	}
+	if v.CloudRef != nil {
+		r.Cloud = refName(*v.CloudRef)
+	}
+	if v.AvailabilityZone != nil {
+		r.AvailabilityZone = *v.AvailabilityZone
+	}
+	if v.Hypervisor != nil {
+		r.Hypervisor = *v.Hypervisor
+	}
+	if v.EnableState != nil {
+		r.EnableState = *v.EnableState
+	}
+	r.Resources = v.Resources
+	if v.LastModified != nil {
+		r.LastModified = *v.LastModified
+	}
+	return r, true
+}
+
+// fetchPools retrieves every pool from Avi.
+func (o *Exporter) fetchPools(ctx context.Context) (r map[string]poolDef, err error) {
+	var vs []*models.Pool
+	err = o.withSession(ctx, func(c *clients.AviClient) (err error) {
+		vs, err = c.Pool.GetAll()
+		return
+	})
 	if err != nil {
-		log.Panic(err)
+		return
 	}
 	r = make(map[string]poolDef)
 	for _, v := range vs {
-		r[*v.UUID] = poolDef{Name: *v.Name}
+		if def, ok := o.newPoolDef(v); ok {
+			r[*v.UUID] = def
+		}
 	}
 	return
 }
 
-// toPrettyJSON formats json output.
-func toPrettyJSON(p interface{}) []byte {
-	bytes, err := json.Marshal(p)
+// fetchServiceEngineGroups retrieves every service engine group from Avi.
+func (o *Exporter) fetchServiceEngineGroups(ctx context.Context) (r map[string]seGroupDef, err error) {
+	var groups []*models.ServiceEngineGroup
+	err = o.withSession(ctx, func(c *clients.AviClient) (err error) {
+		groups, err = c.ServiceEngineGroup.GetAll(includeName)
+		return
+	})
 	if err != nil {
-		log.Println(err.Error())
+		return
 	}
-	return pretty.Pretty(bytes)
+	r = make(map[string]seGroupDef)
+	for _, v := range groups {
+		if v == nil || v.UUID == nil || v.Name == nil {
+			o.skip("serviceenginegroup", "missing uuid or name")
+			continue
+		}
+		def := seGroupDef{Name: *v.Name}
+		if v.CloudRef != nil {
+			def.Cloud = refName(*v.CloudRef)
+		}
+		if v.HaMode != nil {
+			def.HAMode = *v.HaMode
+		}
+		if v.MaxSe != nil {
+			def.MaxSE = *v.MaxSe
+		}
+		if v.BufferSe != nil {
+			def.BufferSE = *v.BufferSe
+		}
+		if v.MaxVsPerSe != nil {
+			def.MaxVSPerSE = *v.MaxVsPerSe
+		}
+		r[*v.UUID] = def
+	}
+	return
 }
 
-// Collect retrieves metrics for Avi.
-func (o *Exporter) Collect() (err error) {
-	log.Println("polling")
-	///////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	// Connect to the cluster.
-	///////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	o.AviClient, err = o.connect()
-	if err != nil {
-		log.Panic(err)
-	}
-	///////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	// Set promMetrics.
-	///////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	err = o.setVirtualServiceMetrics()
-	if err != nil {
-		log.Print(err)
+// fetchPoolGroups retrieves every pool group from Avi.
+func (o *Exporter) fetchPoolGroups(ctx context.Context) (r map[string]poolGroupDef, err error) {
+	var groups []*models.PoolGroup
+	err = o.withSession(ctx, func(c *clients.AviClient) (err error) {
+		groups, err = c.PoolGroup.GetAll()
 		return
-	}
-	err = o.setServiceEngineMetrics()
+	})
 	if err != nil {
-		log.Print(err)
 		return
 	}
-	err = o.setControllerMetrics()
-	if err != nil {
-		log.Print(err)
-		return
+	r = make(map[string]poolGroupDef)
+	for _, v := range groups {
+		if v == nil || v.UUID == nil || v.Name == nil {
+			o.skip("poolgroup", "missing uuid or name")
+			continue
+		}
+		def := poolGroupDef{Name: *v.Name}
+		for _, m := range v.Members {
+			if m != nil && m.PoolRef != nil {
+				def.PoolUUIDs = append(def.PoolUUIDs, formatAviRef(*m.PoolRef))
+			}
+		}
+		r[*v.UUID] = def
 	}
 	return
 }
 
-func (o *Exporter) getVirtualServiceMetrics() (r [][]CollectionResponse, err error) {
-	req := Metrics{}
-	for k, v := range o.GaugeOptsMap {
-		if v.Type == "virtualservice" {
-			reqMetric := MetricRequest{}
-			reqMetric.EntityUUID = "*"
-			reqMetric.MetricEntity = "VSERVER_METRICS_ENTITY"
-			reqMetric.Limit = 1
-			reqMetric.MetricID = k
-			reqMetric.Step = 5
-			req.MetricRequests = append(req.MetricRequests, reqMetric)
-		}
-	}
-
-	resp := make(map[string]map[string][]CollectionResponse)
-	err = o.AviClient.AviSession.Post("/api/analytics/metrics/collection", req, &resp)
-	if err != nil {
-		log.Panic(err)
+// newPoolDef maps a pool.
+func (o *Exporter) newPoolDef(v *models.Pool) (r poolDef, ok bool) {
+	if v == nil || v.UUID == nil || v.Name == nil {
+		o.skip("pool", "missing uuid or name")
 		return
 	}
-	for _, s := range resp["series"] {
-		r = append(r, s)
+	r = poolDef{Name: *v.Name}
+	for _, s := range v.Servers {
+		if s == nil || s.IP == nil || s.IP.Addr == nil {
+			o.skip("pool_server", "no address on a server of "+*v.Name)
+			continue
+		}
+		def := serverDef{IPAddress: *s.IP.Addr}
+		if s.Port != nil {
+			def.Port = *s.Port
+		} else if v.DefaultServerPort != nil {
+			def.Port = *v.DefaultServerPort
+		}
+		if s.Hostname != nil {
+			def.Hostname = *s.Hostname
+		}
+		r.Servers = append(r.Servers, def)
 	}
+	if v.LastModified != nil {
+		r.LastModified = *v.LastModified
+	}
+	return r, true
+}
 
+// fetchModified lists the uuid and _last_modified of every object of the
+// given kind, without the rest of its config.
+func (o *Exporter) fetchModified(ctx context.Context, kind string) (r map[string]string, err error) {
+	r = make(map[string]string)
+	err = o.fetchPages(ctx, "api/"+kind, map[string]string{"fields": "uuid,_last_modified"}, func(obj json.RawMessage) error {
+		var v struct {
+			UUID         string `json:"uuid"`
+			LastModified string `json:"_last_modified"`
+		}
+		if err := json.Unmarshal(obj, &v); err != nil {
+			return err
+		}
+		r[v.UUID] = v.LastModified
+		return nil
+	})
 	return
 }
 
-func (o *Exporter) getServiceEngineMetrics() (r [][]CollectionResponse, err error) {
-	req := Metrics{}
-	for k, v := range o.GaugeOptsMap {
-		if v.Type == "serviceengine" {
-			reqMetric := MetricRequest{}
-			reqMetric.EntityUUID = "*"
-			reqMetric.MetricEntity = "SE_METRICS_ENTITY"
-			reqMetric.Limit = 1
-			reqMetric.MetricID = k
-			reqMetric.Step = 5
-			req.MetricRequests = append(req.MetricRequests, reqMetric)
+// fetchPages retrieves every page of a collection API, such as the inventory
+// APIs that list objects along with their runtime. add is called with each
+// object of each page.
+func (o *Exporter) fetchPages(ctx context.Context, uri string, params map[string]string, add func(obj json.RawMessage) error) (err error) {
+	seen := 0
+	for page := 1; ; page++ {
+		p := map[string]string{"page_size": strconv.Itoa(pageSize), "page": strconv.Itoa(page)}
+		for k, v := range params {
+			p[k] = v
+		}
+		var resp session.AviCollectionResult
+		err = o.withSession(ctx, func(c *clients.AviClient) (err error) {
+			resp, err = c.AviSession.GetCollectionRaw(uri, session.SetParams(p))
+			return
+		})
+		if err != nil {
+			return
+		}
+		var objs []json.RawMessage
+		if len(resp.Results) > 0 {
+			if err = json.Unmarshal(resp.Results, &objs); err != nil {
+				return
+			}
+		}
+		for _, v := range objs {
+			if err = add(v); err != nil {
+				return
+			}
+		}
+		seen += len(objs)
+		if len(objs) == 0 || seen >= resp.Count {
+			return
 		}
 	}
+}
 
-	resp := make(map[string]map[string][]CollectionResponse)
-	err = o.AviClient.AviSession.Post("/api/analytics/metrics/collection", req, &resp)
+// toPrettyJSON formats json output.
+func toPrettyJSON(p interface{}) []byte {
+	bytes, err := json.Marshal(p)
 	if err != nil {
-		log.Panic(err)
-		return
-	}
-	for _, s := range resp["series"] {
-		r = append(r, s)
+		log.Println(err.Error())
 	}
+	return pretty.Pretty(bytes)
+}
 
+// scrape retrieves metrics for Avi. The virtual service, service engine and
+// controller families are collected concurrently under a shared deadline. The
+// metrics of every phase that succeeded replace the ones served by Collect,
+// so one failing family does not hide the others.
+func (o *Exporter) scrape() (err error) {
+	log.Println("polling")
+	ctx, cancel := contextUntil(o.done, o.collectOpts.timeout)
+	defer cancel()
+	s := newScheduler(ctx, o.collectOpts.concurrency)
+	m := new(metricSet)
+	runtime := new(runtimeFetch)
+	///////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	// Set promMetrics.
+	///////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	phases := map[string]func(*scheduler, *metricSet) error{
+		"virtualservice":       o.setVirtualServiceMetrics,
+		"serviceengine":        o.setServiceEngineMetrics,
+		"controller":           o.setControllerMetrics,
+		"pool":                 o.setPoolMetrics,
+		"server":               o.setServerMetrics,
+		"pool_member":          o.setPoolMemberMetrics,
+		"virtualservice_state": o.setVirtualServiceStateMetrics,
+		"serviceengine_state":  o.setServiceEngineStateMetrics,
+		"serviceenginegroup":   o.setServiceEngineGroupMetrics,
+		"controller_state":     func(s *scheduler, m *metricSet) error { return o.setControllerStateMetrics(s, m, runtime) },
+		"build_info":           func(s *scheduler, m *metricSet) error { return o.setBuildInfoMetrics(s, m, runtime) },
+		"certificate":          o.setCertificateMetrics,
+		"alert":                o.setAlertMetrics,
+		"event":                o.setEventMetrics,
+	}
+	var wg sync.WaitGroup
+	var reached int32
+	for name, fn := range phases {
+		wg.Add(1)
+		go func(name string, fn func(*scheduler, *metricSet) error) {
+			defer wg.Done()
+			if o.runPhase(name, s, m, fn) {
+				atomic.StoreInt32(&reached, 1)
+			}
+		}(name, fn)
+	}
+	wg.Wait()
+	///////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	// Publish whatever succeeded.
+	///////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	o.metricsMtx.Lock()
+	o.metrics = m.metrics
+	o.metricsMtx.Unlock()
+	o.counters.prune()
+	if atomic.LoadInt32(&reached) > 0 {
+		o.phaseMetrics.up.Set(1)
+	} else {
+		o.phaseMetrics.up.Set(0)
+	}
+	if len(m.errs) > 0 {
+		err = m.errs[0]
+		return
+	}
+	o.lastSuccess.SetToCurrentTime()
 	return
 }
 
-func (o *Exporter) getControllerMetrics() (r [][]CollectionResponse, err error) {
-	req := Metrics{}
-	for k, v := range o.GaugeOptsMap {
-		if v.Type == "controller" {
-			reqMetric := MetricRequest{}
-			reqMetric.EntityUUID = "*"
-			reqMetric.MetricEntity = "CONTROLLER_METRICS_ENTITY"
-			reqMetric.Limit = 1
-			reqMetric.MetricID = k
-			reqMetric.Step = 5
-			req.MetricRequests = append(req.MetricRequests, reqMetric)
-		}
+func (o *Exporter) setVirtualServiceMetrics(s *scheduler, m *metricSet) (err error) {
+	c := o.currentCatalog()
+	if !c.collects("virtualservice") {
+		return
 	}
-
-	resp := make(map[string]map[string][]CollectionResponse)
-	err = o.AviClient.AviSession.Post("/api/analytics/metrics/collection", req, &resp)
+	var vs map[string]virtualServiceDef
+	var pools map[string]poolDef
+	var results []CollectionResponse
+	///////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	// Get lb objects for mapping alongside the metrics.
+	///////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	err = s.run(
+		func() error { return s.call(func() (err error) { vs, err = o.getVirtualServices(s.ctx); return }) },
+		func() error { return s.call(func() (err error) { pools, err = o.getPools(s.ctx); return }) },
+		func() error {
+			return s.fetch(func() (err error) { results, err = o.getMetrics(s.ctx, c, "virtualservice"); return })
+		},
+	)
 	if err != nil {
-		log.Panic(err)
 		return
 	}
-	for _, s := range resp["series"] {
-		r = append(r, s)
+	///////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	missing := false
+	for _, v1 := range results {
+		if _, ok := vs[v1.Header.EntityUUID]; !ok {
+			missing = true
+		}
+		var labels prometheus.Labels
+		labels = make(map[string]string)
+		labels["name"] = vs[v1.Header.EntityUUID].Name
+		labels["entity_uuid"] = v1.Header.EntityUUID
+		labels["pool"] = pools[vs[v1.Header.EntityUUID].PoolUUID].Name
+		labels["tenant_uuid"] = v1.Header.TenantUUID
+		labels["cluster"] = o.clusterLabel()
+		labels["units"] = v1.Header.Units
+		labels["fqdn"] = vs[v1.Header.EntityUUID].FQDN
+		labels["ipaddress"] = vs[v1.Header.EntityUUID].IPAddress
+		value, ok := o.seriesValue(c, v1.Header.Name, v1)
+		if !ok {
+			continue
+		}
+		o.addSeries(c, m, v1.Header.Name, labels, value)
+	}
+	if missing {
+		o.inventory.virtualServices.expire()
 	}
-
 	return
 }
 
-func (o *Exporter) setVirtualServiceMetrics() (err error) {
-	///////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	// Get lb objects for mapping.
-	///////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	vs, _ := o.getVirtualServices()
-	pools, _ := o.getPools()
-	///////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	results, err := o.getVirtualServiceMetrics()
+func (o *Exporter) setServiceEngineMetrics(s *scheduler, m *metricSet) (err error) {
+	c := o.currentCatalog()
+	if !c.collects("serviceengine") {
+		return
+	}
+	var ses map[string]seDef
+	var results []CollectionResponse
+	err = s.run(
+		func() error {
+			return s.fetch(func() (err error) { results, err = o.getMetrics(s.ctx, c, "serviceengine"); return })
+		},
+		func() error { return s.call(func() (err error) { ses, err = o.getServiceEngines(s.ctx); return }) },
+	)
 	if err != nil {
-		log.Panic(err)
 		return
 	}
-	for _, v := range results {
-		for _, v1 := range v {
-			var labels prometheus.Labels
-			labels = make(map[string]string)
-			labels["name"] = vs[v1.Header.EntityUUID].Name
-			labels["pool"] = pools[vs[v1.Header.EntityUUID].PoolUUID].Name
-			labels["tenant_uuid"] = v1.Header.TenantUUID
-			labels["cluster"] = o.connectionOpts.cluster
-			labels["units"] = v1.Header.Units
-			labels["fqdn"] = vs[v1.Header.EntityUUID].FQDN
-			labels["ipaddress"] = vs[v1.Header.EntityUUID].IPAddress
-			o.guages[v1.Header.Name].With(labels).Set(v1.Data[len(v1.Data)-1].Value)
+	missing := false
+	for _, v1 := range results {
+		if _, ok := ses[v1.Header.EntityUUID]; !ok {
+			missing = true
+		}
+		var labels prometheus.Labels
+		labels = make(map[string]string)
+		labels["tenant_uuid"] = v1.Header.TenantUUID
+		labels["entity_uuid"] = v1.Header.EntityUUID
+		labels["cluster"] = o.clusterLabel()
+		labels["units"] = v1.Header.Units
+		labels["name"] = ses[v1.Header.EntityUUID].Name
+		labels["fqdn"] = ses[v1.Header.EntityUUID].FQDN
+		labels["ipaddress"] = ses[v1.Header.EntityUUID].IPAddress
+		value, ok := o.seriesValue(c, v1.Header.Name, v1)
+		if !ok {
+			continue
 		}
+		o.addSeries(c, m, v1.Header.Name, labels, value)
+	}
+	if missing {
+		o.inventory.serviceEngines.expire()
 	}
 	return
 }
 
-func (o *Exporter) setServiceEngineMetrics() (err error) {
-	results, err := o.getServiceEngineMetrics()
-	ses, _ := o.getServiceEngines()
+func (o *Exporter) setControllerMetrics(s *scheduler, m *metricSet) (err error) {
+	c := o.currentCatalog()
+	if !c.collects("controller") {
+		return
+	}
+	var runtime map[string]clusterDef
+	var results []CollectionResponse
+	err = s.run(
+		func() error {
+			return s.fetch(func() (err error) { results, err = o.getMetrics(s.ctx, c, "controller"); return })
+		},
+		func() error { return s.call(func() (err error) { runtime, err = o.getClusterRuntime(s.ctx); return }) },
+	)
 	if err != nil {
-		log.Panic(err)
 		return
 	}
-	for _, v := range results {
-		for _, v1 := range v {
-			var labels prometheus.Labels
-			labels = make(map[string]string)
-			labels["tenant_uuid"] = v1.Header.TenantUUID
-			labels["entity_uuid"] = v1.Header.EntityUUID
-			labels["cluster"] = o.connectionOpts.cluster
-			labels["units"] = v1.Header.Units
-			labels["name"] = ses[v1.Header.EntityUUID].Name
-			labels["fqdn"] = ses[v1.Header.EntityUUID].FQDN
-			labels["ipaddress"] = ses[v1.Header.EntityUUID].IPAddress
-			o.guages[v1.Header.Name].With(labels).Set(v1.Data[len(v1.Data)-1].Value)
+	for _, v1 := range results {
+		var labels prometheus.Labels
+		labels = make(map[string]string)
+		labels["tenant_uuid"] = v1.Header.TenantUUID
+		labels["entity_uuid"] = v1.Header.EntityUUID
+		labels["cluster"] = o.clusterLabel()
+		labels["units"] = v1.Header.Units
+		labels["name"] = runtime[v1.Header.EntityUUID].Name
+		labels["fqdn"] = runtime[v1.Header.EntityUUID].FQDN
+		labels["ipaddress"] = runtime[v1.Header.EntityUUID].IPAddress
+		value, ok := o.seriesValue(c, v1.Header.Name, v1)
+		if !ok {
+			continue
 		}
+		o.addSeries(c, m, v1.Header.Name, labels, value)
 	}
 	return
 }
 
-func (o *Exporter) setControllerMetrics() (err error) {
-	results, err := o.getControllerMetrics()
-	runtime, _ := o.getClusterRuntime()
+// poolOwners maps each pool to the sorted names of the virtual services using
+// it, directly or through a pool group.
+func poolOwners(vs map[string]virtualServiceDef, groups map[string]poolGroupDef) (r map[string][]string) {
+	r = make(map[string][]string)
+	for _, v := range vs {
+		pools := groups[v.PoolGroupUUID].PoolUUIDs
+		if v.PoolUUID != "" {
+			pools = append([]string{v.PoolUUID}, pools...)
+		}
+		for _, p := range pools {
+			r[p] = append(r[p], v.Name)
+		}
+	}
+	for k, v := range r {
+		r[k], _ = sortUniqueKeys(v)
+	}
+	return
+}
 
+func (o *Exporter) setPoolMetrics(s *scheduler, m *metricSet) (err error) {
+	c := o.currentCatalog()
+	if !c.collects("pool") {
+		return
+	}
+	var vs map[string]virtualServiceDef
+	var pools map[string]poolDef
+	var groups map[string]poolGroupDef
+	var results []CollectionResponse
+	err = s.run(
+		func() error { return s.call(func() (err error) { vs, err = o.getVirtualServices(s.ctx); return }) },
+		func() error { return s.call(func() (err error) { pools, err = o.getPools(s.ctx); return }) },
+		func() error { return s.call(func() (err error) { groups, err = o.getPoolGroups(s.ctx); return }) },
+		func() error {
+			return s.fetch(func() (err error) { results, err = o.getMetrics(s.ctx, c, "pool"); return })
+		},
+	)
 	if err != nil {
-		log.Panic(err)
-		return
-	}
-	for _, v := range results {
-		for _, v1 := range v {
-			var labels prometheus.Labels
-			labels = make(map[string]string)
-			labels["tenant_uuid"] = v1.Header.TenantUUID
-			labels["entity_uuid"] = v1.Header.EntityUUID
-			labels["cluster"] = o.connectionOpts.cluster
-			labels["units"] = v1.Header.Units
-			labels["name"] = runtime[v1.Header.EntityUUID].Name
-			labels["fqdn"] = runtime[v1.Header.EntityUUID].FQDN
-			labels["ipaddress"] = runtime[v1.Header.EntityUUID].IPAddress
-			o.guages[v1.Header.Name].With(labels).Set(v1.Data[len(v1.Data)-1].Value)
+		return
+	}
+	owners := poolOwners(vs, groups)
+	missing := false
+	for _, v1 := range results {
+		//////////////////////////////////////////////////////////////////////////
+		// Series scoped to a virtual service carry the pool in pool_uuid;
+		// otherwise the entity is the pool itself and every owner is listed.
+		//////////////////////////////////////////////////////////////////////////
+		poolUUID := v1.Header.PoolUUID
+		owner := ""
+		if poolUUID == "" {
+			poolUUID = v1.Header.EntityUUID
+			owner = strings.Join(owners[poolUUID], ",")
+		} else {
+			owner = vs[v1.Header.EntityUUID].Name
+		}
+		if _, ok := pools[poolUUID]; !ok {
+			missing = true
 		}
+		var labels prometheus.Labels
+		labels = make(map[string]string)
+		labels["name"] = pools[poolUUID].Name
+		labels["pool_uuid"] = poolUUID
+		labels["entity_uuid"] = v1.Header.EntityUUID
+		labels["virtualservice"] = owner
+		labels["tenant_uuid"] = v1.Header.TenantUUID
+		labels["cluster"] = o.clusterLabel()
+		labels["units"] = v1.Header.Units
+		key := metricKey("pool", v1.Header.Name)
+		value, ok := o.seriesValue(c, key, v1)
+		if !ok {
+			continue
+		}
+		o.addSeries(c, m, key, labels, value)
+	}
+	if missing {
+		o.inventory.pools.expire()
 	}
 	return
 }
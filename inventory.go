@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/avinetworks/sdk/go/clients"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// inventoryMetrics describes the self-metrics of the inventory cache.
+type inventoryMetrics struct {
+	hits            *prometheus.CounterVec
+	misses          *prometheus.CounterVec
+	refreshDuration *prometheus.GaugeVec
+}
+
+func newInventoryMetrics() (r *inventoryMetrics) {
+	r = new(inventoryMetrics)
+	r.hits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "avi_exporter_inventory_cache_hits_total",
+		Help: "Number of inventory lookups answered from the cache.",
+	}, []string{"kind"})
+	r.misses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "avi_exporter_inventory_cache_misses_total",
+		Help: "Number of inventory lookups that had to fetch from Avi.",
+	}, []string{"kind"})
+	r.refreshDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "avi_exporter_inventory_refresh_duration_seconds",
+		Help: "Duration of the last inventory refresh from Avi.",
+	}, []string{"kind"})
+	return
+}
+
+// minInventoryRefresh is how long a cache is kept at least before a lookup
+// miss expires it.
+const minInventoryRefresh = time.Minute
+
+// inventoryCache keeps the objects of one kind for up to ttl. A refresh is
+// handed the previous value so that it can update it incrementally. used
+// reports whether an enabled collector looks the objects up.
+type inventoryCache struct {
+	kind       string
+	ttl        time.Duration
+	refresh    func(ctx context.Context, old interface{}) (interface{}, error)
+	used       func() bool
+	metrics    *inventoryMetrics
+	mtx        sync.RWMutex
+	refreshMtx sync.Mutex
+	value      interface{}
+	updated    time.Time
+}
+
+// fresh returns the cached value when it is younger than the TTL.
+func (o *inventoryCache) fresh() (r interface{}, ok bool) {
+	o.mtx.RLock()
+	defer o.mtx.RUnlock()
+	if o.value == nil || time.Since(o.updated) >= o.ttl {
+		return
+	}
+	return o.value, true
+}
+
+// get returns the cached objects, refreshing them first when they are
+// missing or expired.
+func (o *inventoryCache) get(ctx context.Context) (r interface{}, err error) {
+	if r, ok := o.fresh(); ok {
+		o.metrics.hits.WithLabelValues(o.kind).Inc()
+		return r, nil
+	}
+	o.metrics.misses.WithLabelValues(o.kind).Inc()
+	return o.update(ctx, false)
+}
+
+// expire makes the next lookup refresh the cache, unless it was refreshed
+// less than minInventoryRefresh ago. It is called when Avi reports on objects
+// the cache does not have yet.
+func (o *inventoryCache) expire() {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	if time.Since(o.updated) >= minInventoryRefresh {
+		o.updated = time.Time{}
+	}
+}
+
+// update refreshes the cache. Concurrent callers wait for the refresh in
+// progress instead of starting their own. When a refresh fails, the stale
+// value is kept and returned if there is one.
+func (o *inventoryCache) update(ctx context.Context, force bool) (r interface{}, err error) {
+	o.refreshMtx.Lock()
+	defer o.refreshMtx.Unlock()
+	if r, ok := o.fresh(); ok && !force {
+		return r, nil
+	}
+	o.mtx.RLock()
+	old := o.value
+	o.mtx.RUnlock()
+
+	start := time.Now()
+	err = safeCall(func() (err error) {
+		r, err = o.refresh(ctx, old)
+		return
+	})
+	o.metrics.refreshDuration.WithLabelValues(o.kind).Set(time.Since(start).Seconds())
+	if err != nil {
+		if old != nil {
+			log.Printf("serving stale %s inventory: %v", o.kind, err)
+			return old, nil
+		}
+		return
+	}
+	o.mtx.Lock()
+	o.value = r
+	o.updated = time.Now()
+	o.mtx.Unlock()
+	return
+}
+
+// inventory caches the Avi config used to label metrics, which rarely changes.
+type inventory struct {
+	virtualServices *inventoryCache
+	pools           *inventoryCache
+	poolGroups      *inventoryCache
+	serviceEngines  *inventoryCache
+	seGroups        *inventoryCache
+	certificates    *inventoryCache
+	alertConfigs    *inventoryCache
+	clusterNodes    *inventoryCache
+}
+
+// newInventory wires the caches to the exporter's fetch functions.
+func (o *Exporter) newInventory(m *inventoryMetrics) (r *inventory) {
+	cache := func(kind string, refresh func(ctx context.Context, old interface{}) (interface{}, error)) *inventoryCache {
+		used := func() bool { return o.usesInventory(kind) }
+		return &inventoryCache{kind: kind, ttl: o.inventoryOpts.ttl, refresh: refresh, used: used, metrics: m}
+	}
+	r = new(inventory)
+	r.virtualServices = cache("virtualservice", o.refreshVirtualServices)
+	r.pools = cache("pool", o.refreshPools)
+	r.poolGroups = cache("poolgroup", func(ctx context.Context, _ interface{}) (interface{}, error) { return o.fetchPoolGroups(ctx) })
+	r.serviceEngines = cache("serviceengine", o.refreshServiceEngines)
+	r.seGroups = cache("serviceenginegroup", func(ctx context.Context, _ interface{}) (interface{}, error) { return o.fetchServiceEngineGroups(ctx) })
+	r.certificates = cache("sslkeyandcertificate", func(ctx context.Context, _ interface{}) (interface{}, error) { return o.fetchCertificates(ctx) })
+	r.alertConfigs = cache("alertconfig", func(ctx context.Context, _ interface{}) (interface{}, error) { return o.fetchAlertConfigs(ctx) })
+	r.clusterNodes = cache("cluster", func(ctx context.Context, _ interface{}) (interface{}, error) { return o.fetchClusterRuntime(ctx) })
+	return
+}
+
+// usesInventory reports whether an enabled collector looks up the objects of
+// the kind.
+func (o *Exporter) usesInventory(kind string) bool {
+	c := o.currentConfig().Collectors
+	collects := o.currentCatalog().collects
+	switch kind {
+	case "virtualservice":
+		return collects("virtualservice") || collects("pool") || collects("server") || c.PoolMembers || c.VirtualServices || c.SEGroups || c.Certificates
+	case "pool":
+		return collects("virtualservice") || collects("pool") || collects("server") || c.PoolMembers || c.VirtualServices
+	case "poolgroup":
+		return collects("pool") || collects("server") || c.PoolMembers
+	case "serviceengine":
+		return collects("serviceengine") || c.ServiceEngines || c.SEGroups
+	case "serviceenginegroup":
+		return c.SEGroups
+	case "sslkeyandcertificate":
+		return c.Certificates
+	case "alertconfig":
+		return c.Alerts
+	case "cluster":
+		return collects("controller")
+	}
+	return false
+}
+
+func (o *inventory) caches() []*inventoryCache {
+	return []*inventoryCache{o.virtualServices, o.pools, o.poolGroups, o.serviceEngines, o.seGroups, o.certificates, o.alertConfigs, o.clusterNodes}
+}
+
+// start refreshes the caches in background at half the TTL, so that scrapes
+// only miss before the first refresh or when Avi is unreachable. Caches no
+// enabled collector uses are left alone, which is checked on every round
+// since reloads change the collectors. Each refresh gets timeout to complete.
+func (o *inventory) start(ttl time.Duration, timeout time.Duration, done <-chan struct{}) {
+	if ttl <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(ttl / 2)
+		defer ticker.Stop()
+		for {
+			for _, c := range o.caches() {
+				if !c.used() {
+					continue
+				}
+				ctx, cancel := contextUntil(done, timeout)
+				if _, err := c.update(ctx, true); err != nil {
+					log.Printf("refreshing %s inventory: %v", c.kind, err)
+				}
+				cancel()
+			}
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// reset drops every cached object once the refresh in progress, if any, is
+// done, so that the next lookup fetches them again.
+func (o *inventory) reset() {
+	for _, c := range o.caches() {
+		c.refreshMtx.Lock()
+		c.mtx.Lock()
+		c.value = nil
+		c.mtx.Unlock()
+		c.refreshMtx.Unlock()
+	}
+}
+
+func (o *Exporter) getVirtualServices(ctx context.Context) (r map[string]virtualServiceDef, err error) {
+	v, err := o.inventory.virtualServices.get(ctx)
+	r, _ = v.(map[string]virtualServiceDef)
+	return
+}
+
+func (o *Exporter) getPools(ctx context.Context) (r map[string]poolDef, err error) {
+	v, err := o.inventory.pools.get(ctx)
+	r, _ = v.(map[string]poolDef)
+	return
+}
+
+func (o *Exporter) getPoolGroups(ctx context.Context) (r map[string]poolGroupDef, err error) {
+	v, err := o.inventory.poolGroups.get(ctx)
+	r, _ = v.(map[string]poolGroupDef)
+	return
+}
+
+func (o *Exporter) getServiceEngineGroups(ctx context.Context) (r map[string]seGroupDef, err error) {
+	v, err := o.inventory.seGroups.get(ctx)
+	r, _ = v.(map[string]seGroupDef)
+	return
+}
+
+func (o *Exporter) getCertificates(ctx context.Context) (r map[string]certDef, err error) {
+	v, err := o.inventory.certificates.get(ctx)
+	r, _ = v.(map[string]certDef)
+	return
+}
+
+func (o *Exporter) getAlertConfigs(ctx context.Context) (r map[string]alertConfigDef, err error) {
+	v, err := o.inventory.alertConfigs.get(ctx)
+	r, _ = v.(map[string]alertConfigDef)
+	return
+}
+
+func (o *Exporter) getServiceEngines(ctx context.Context) (r map[string]seDef, err error) {
+	v, err := o.inventory.serviceEngines.get(ctx)
+	r, _ = v.(map[string]seDef)
+	return
+}
+
+func (o *Exporter) getClusterRuntime(ctx context.Context) (r map[string]clusterDef, err error) {
+	v, err := o.inventory.clusterNodes.get(ctx)
+	r, _ = v.(map[string]clusterDef)
+	return
+}
+
+// refreshVirtualServices refetches the virtual services. In incremental mode
+// only the objects whose _last_modified changed are fetched again.
+func (o *Exporter) refreshVirtualServices(ctx context.Context, old interface{}) (r interface{}, err error) {
+	cached, _ := old.(map[string]virtualServiceDef)
+	if !o.inventoryOpts.incremental || cached == nil {
+		return o.fetchVirtualServices(ctx)
+	}
+	modified, err := o.fetchModified(ctx, "virtualservice")
+	if err != nil {
+		return
+	}
+	vs := make(map[string]virtualServiceDef)
+	for uuid, lastModified := range modified {
+		if v, ok := cached[uuid]; ok && v.LastModified == lastModified {
+			vs[uuid] = v
+			continue
+		}
+		err = o.withSession(ctx, func(c *clients.AviClient) error {
+			v, err := c.VirtualService.Get(uuid)
+			if err != nil {
+				return err
+			}
+			if def, ok := o.newVirtualServiceDef(v); ok {
+				vs[uuid] = def
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+	}
+	return vs, nil
+}
+
+// refreshPools refetches the pools, incrementally when enabled.
+func (o *Exporter) refreshPools(ctx context.Context, old interface{}) (r interface{}, err error) {
+	cached, _ := old.(map[string]poolDef)
+	if !o.inventoryOpts.incremental || cached == nil {
+		return o.fetchPools(ctx)
+	}
+	modified, err := o.fetchModified(ctx, "pool")
+	if err != nil {
+		return
+	}
+	pools := make(map[string]poolDef)
+	for uuid, lastModified := range modified {
+		if v, ok := cached[uuid]; ok && v.LastModified == lastModified {
+			pools[uuid] = v
+			continue
+		}
+		err = o.withSession(ctx, func(c *clients.AviClient) error {
+			v, err := c.Pool.Get(uuid)
+			if err != nil {
+				return err
+			}
+			if def, ok := o.newPoolDef(v); ok {
+				pools[uuid] = def
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+	}
+	return pools, nil
+}
+
+// refreshServiceEngines refetches the service engines, incrementally when
+// enabled.
+func (o *Exporter) refreshServiceEngines(ctx context.Context, old interface{}) (r interface{}, err error) {
+	cached, _ := old.(map[string]seDef)
+	if !o.inventoryOpts.incremental || cached == nil {
+		return o.fetchServiceEngines(ctx)
+	}
+	modified, err := o.fetchModified(ctx, "serviceengine")
+	if err != nil {
+		return
+	}
+	ses := make(map[string]seDef)
+	for uuid, lastModified := range modified {
+		if v, ok := cached[uuid]; ok && v.LastModified == lastModified {
+			ses[uuid] = v
+			continue
+		}
+		err = o.withSession(ctx, func(c *clients.AviClient) error {
+			v, err := c.ServiceEngine.Get(uuid, includeName)
+			if err != nil {
+				return err
+			}
+			if def, ok := o.newSeDef(v); ok {
+				ses[uuid] = def
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+	}
+	return ses, nil
+}
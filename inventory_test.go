@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestFetchModifiedPages(t *testing.T) {
+	server, _ := newFakeAPI(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/pool" {
+			w.Write([]byte(`{}`))
+			return
+		}
+		switch req.URL.Query().Get("page") {
+		case "1":
+			w.Write([]byte(`{"count": 3, "results": [{"uuid": "pool-1", "_last_modified": "1"}, {"uuid": "pool-2", "_last_modified": "2"}]}`))
+		case "2":
+			w.Write([]byte(`{"count": 3, "results": [{"uuid": "pool-3", "_last_modified": "3"}]}`))
+		default:
+			w.Write([]byte(`{"count": 3, "results": []}`))
+		}
+	})
+	defer server.Close()
+	o := newSessionTestExporter(server, 1)
+	modified, err := o.fetchModified(context.Background(), "pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(modified) != 3 || modified["pool-3"] != "3" {
+		t.Errorf("modified = %v, want the 3 pools of both pages", modified)
+	}
+}
+
+func TestUsesInventory(t *testing.T) {
+	metrics := GaugeOptsMap{
+		"se_stats.avg_cpu_usage": {Type: "serviceengine", MetricID: "se_stats.avg_cpu_usage", GaugeOpts: prometheus.GaugeOpts{Name: "se_stats_avg_cpu_usage", Help: "h"}, CustomLabels: customLabels["serviceengine"]},
+	}
+	tests := []struct {
+		name       string
+		collectors CollectorsConfig
+		used       []string
+	}{
+		{"metrics only", CollectorsConfig{}, []string{"serviceengine"}},
+		{"alerts", CollectorsConfig{Alerts: true}, []string{"serviceengine", "alertconfig"}},
+		{"pool members", CollectorsConfig{PoolMembers: true}, []string{"serviceengine", "virtualservice", "pool", "poolgroup"}},
+		{"certificates", CollectorsConfig{Certificates: true}, []string{"serviceengine", "virtualservice", "sslkeyandcertificate"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, c := newTestExporter(metrics)
+			cfg := o.currentConfig()
+			cfg.Collectors = tt.collectors
+			o.config.Store(cfg)
+			o.catalog.Store(c)
+			used := make(map[string]bool)
+			for _, v := range tt.used {
+				used[v] = true
+			}
+			for _, kind := range []string{"virtualservice", "pool", "poolgroup", "serviceengine", "serviceenginegroup", "sslkeyandcertificate", "alertconfig", "cluster"} {
+				if got := o.usesInventory(kind); got != used[kind] {
+					t.Errorf("usesInventory(%s) = %v, want %v", kind, got, used[kind])
+				}
+			}
+		})
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"flag"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"time"
 
@@ -15,56 +14,137 @@ import (
 )
 
 var (
-	hosturl       = flag.String(os.Getenv("AVI_CLUSTER"), "", "AVI Cluster URL.")
-	listenAddress = flag.String("web.listen-address", ":8080", "Address to listen on for web interface and telemetry.")
-	metricsPath   = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+	configFile           = flag.String("config.file", "", "Path to the JSON configuration file.")
+	aviCluster           = flag.String("avi.cluster", "", "AVI Cluster URL. Overrides the config file and AVI_CLUSTER.")
+	listenAddress        = flag.String("web.listen-address", ":8080", "Address to listen on for web interface and telemetry.")
+	metricsPath          = flag.String("web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+	interval             = flag.Duration("collect.interval", 30*time.Second, "Interval between background collections. Set to 0 to collect on every scrape.")
+	concurrency          = flag.Int("collect.concurrency", 4, "Maximum number of concurrent Avi API calls, each on a session of its own.")
+	timeout              = flag.Duration("collect.timeout", 60*time.Second, "Deadline for a whole collection, shared by all of its API calls.")
+	poolMemberInterval   = flag.Duration("collect.pool-member-interval", time.Minute, "Interval between refreshes of the pool member state, which takes one API call per pool and runs apart from the collections.")
+	inventoryTTL         = flag.Duration("inventory.ttl", 5*time.Minute, "How long virtual services, pools, service engines and cluster nodes are cached. Set to 0 to fetch them on every collection.")
+	inventoryIncremental = flag.Bool("inventory.incremental", false, "Only refetch inventory objects whose _last_modified changed.")
+	discovery            = flag.Bool("metrics.discovery", false, "Derive the metric list from the controller's /api/analytics/metrics-option catalog.")
+	discoveryInterval    = flag.Duration("metrics.discovery-interval", time.Hour, "Interval between refreshes of the discovered metric catalog.")
+	targetsFile          = flag.String("config.targets-file", "", "Path to the JSON file with per-target credentials for /probe.")
+	conformantNames      = flag.Bool("metrics.conformant-names", false, "Name metrics avi_<entity>_<metric>_<unit> with values in base units and no units label.")
+	legacyNames          = flag.Bool("metrics.legacy-names", false, "Keep exporting the legacy metric names alongside the conformant ones.")
+	watchInterval        = flag.Duration("config.watch-interval", 10*time.Second, "Interval between checks of the config and metric files for changes. Set to 0 to only reload on SIGHUP or POST /-/reload.")
+	probeIdleTimeout     = flag.Duration("probe.idle-timeout", 15*time.Minute, "How long the exporter of a /probe target is kept without being probed. Set to 0 to keep them until they are removed from the targets.")
 )
 
+// applyFlags lets the flags given on the command line override the config.
+func applyFlags(c *Config) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "web.listen-address":
+			c.Web.ListenAddress = *listenAddress
+		case "web.telemetry-path":
+			c.Web.TelemetryPath = *metricsPath
+		case "avi.cluster":
+			c.Avi.Cluster = *aviCluster
+		case "metrics.conformant-names":
+			c.Metrics.Naming.Conformant = *conformantNames
+		case "metrics.legacy-names":
+			c.Metrics.Naming.KeepLegacy = *legacyNames
+		case "collect.interval":
+			c.Collect.Interval = *interval
+		case "collect.concurrency":
+			c.Collect.Concurrency = *concurrency
+		case "collect.timeout":
+			c.Collect.Timeout = *timeout
+		case "collect.pool-member-interval":
+			c.Collect.PoolMemberInterval = *poolMemberInterval
+		case "inventory.ttl":
+			c.Collect.InventoryTTL = *inventoryTTL
+		case "inventory.incremental":
+			c.Collect.InventoryIncremental = *inventoryIncremental
+		case "metrics.discovery":
+			c.Collect.Discovery = *discovery
+		case "metrics.discovery-interval":
+			c.Collect.DiscoveryInterval = *discoveryInterval
+		}
+	})
+}
+
 func main() {
 	flag.Parse()
+	c, err := loadConfig(*configFile)
+	if err != nil {
+		log.Print(err)
+		os.Exit(-1)
+	}
+	applyFlags(&c)
+	if err = c.validate(); err != nil {
+		log.Print(err)
+		os.Exit(-1)
+	}
 	//////////////////////////////////////////////////////////////////////////////
 	// Set metrics endpoint.
 	//////////////////////////////////////////////////////////////////////////////
-	e := NewExporter()
-	e.registerGauges()
-	http.Handle("/metrics", myPromHTTPHandler(e, prometheus.DefaultGatherer, promhttp.HandlerOpts{}))
+	var e *Exporter
+	if c.Avi.Cluster != "" {
+		e, err = NewExporter(c)
+		if err != nil {
+			log.Print(err)
+			os.Exit(-1)
+		}
+		if c.Collect.Interval > 0 {
+			e.startPoller(c.Collect.Interval)
+			http.Handle(c.Web.TelemetryPath, promhttp.HandlerFor(prometheus.Gatherers{e, prometheus.DefaultGatherer}, promhttp.HandlerOpts{ErrorHandling: promhttp.ContinueOnError}))
+		} else {
+			http.Handle(c.Web.TelemetryPath, myPromHTTPHandler(e, prometheus.Gatherers{e, prometheus.DefaultGatherer}, promhttp.HandlerOpts{ErrorHandling: promhttp.ContinueOnError}))
+		}
+	} else {
+		http.Handle(c.Web.TelemetryPath, promhttp.Handler())
+	}
+	//////////////////////////////////////////////////////////////////////////////
+	// Set multi-cluster probe endpoint.
+	//////////////////////////////////////////////////////////////////////////////
+	var p *probeRegistry
+	if *targetsFile != "" || len(c.Targets) > 0 {
+		p, err = newProbeRegistry(c, *targetsFile, *probeIdleTimeout)
+		if err != nil {
+			log.Print(err)
+			os.Exit(-1)
+		}
+		http.Handle("/probe", probeHandler(p))
+	}
+	//////////////////////////////////////////////////////////////////////////////
+	// Set reload endpoint.
+	//////////////////////////////////////////////////////////////////////////////
+	reloader := newReloader(c, *configFile, *targetsFile, e, p)
+	reloader.start(*watchInterval)
+	http.Handle("/-/reload", reloader.handler())
 	//////////////////////////////////////////////////////////////////////////////
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
              <head><title>AVI Exporter</title></head>
              <body>
              <h1>AVI Exporter</h1>
-             <p><a href='` + *metricsPath + `'>Metrics</a></p>
+             <p><a href='` + c.Web.TelemetryPath + `'>Metrics</a></p>
              </body>
              </html>`))
 	})
 	//////////////////////////////////////////////////////////////////////////////
 	// Set service health endpoint.
 	//////////////////////////////////////////////////////////////////////////////
-	u, err := url.Parse(*hosturl)
-	if err != nil {
-		log.Print(err)
-		os.Exit(-1)
-	}
 	health := healthcheck.NewHandler()
-	var port string
-	if u.Port() == "" {
-		if u.Scheme == "https" {
-			port = "443"
-		} else {
-			port = "80"
+	if c.Avi.Cluster != "" {
+		address, err := c.Avi.clusterAddress()
+		if err != nil {
+			log.Print(err)
+			os.Exit(-1)
 		}
-	} else {
-		port = u.Port()
-	}
 
-	health.AddReadinessCheck(
-		"avi-tcp",
-		healthcheck.Async(healthcheck.TCPDialCheck(u.Host+":"+port, 50*time.Millisecond), 10*time.Second))
+		health.AddReadinessCheck(
+			"avi-tcp",
+			healthcheck.Async(healthcheck.TCPDialCheck(address, 50*time.Millisecond), 10*time.Second))
+	}
 
 	http.HandleFunc("/live", health.LiveEndpoint)
 	http.HandleFunc("/healthz", health.ReadyEndpoint)
 	//////////////////////////////////////////////////////////////////////////////
-	glog.Infoln("Starting HTTP server on", *listenAddress)
-	glog.Exitf(http.ListenAndServe(*listenAddress, nil).Error())
+	glog.Infoln("Starting HTTP server on", c.Web.ListenAddress)
+	glog.Exit(http.ListenAndServe(c.Web.ListenAddress, nil))
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log"
+
+	"github.com/avinetworks/sdk/go/models"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newMalformedCounter returns the counter of Avi objects whose shape the
+// exporter did not expect.
+func newMalformedCounter() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "avi_exporter_malformed_objects_total",
+		Help: "Number of Avi objects that were skipped, fully or in part, because of an unexpected shape.",
+	}, []string{"kind"})
+}
+
+// skip counts an object of the given kind that could not be used as is.
+func (o *Exporter) skip(kind string, reason string) {
+	log.Printf("skipping malformed %s: %s", kind, reason)
+	o.malformed.WithLabelValues(kind).Inc()
+}
+
+// vsAddress returns the first inline VIP address of the virtual service.
+// Virtual services that reference a VsVip object have no inline VIP.
+func vsAddress(v *models.VirtualService) (r string, ok bool) {
+	if len(v.Vip) == 0 || v.Vip[0] == nil || v.Vip[0].IPAddress == nil || v.Vip[0].IPAddress.Addr == nil {
+		return
+	}
+	return *v.Vip[0].IPAddress.Addr, true
+}
+
+// seAddress returns the management address of the service engine. Service
+// engines that are still coming up have no management network yet.
+func seAddress(v *models.ServiceEngine) (r string, ok bool) {
+	if v.MgmtVnic == nil || len(v.MgmtVnic.VnicNetworks) == 0 {
+		return
+	}
+	n := v.MgmtVnic.VnicNetworks[0]
+	if n == nil || n.IP == nil || n.IP.IPAddr == nil || n.IP.IPAddr.Addr == nil {
+		return
+	}
+	return *n.IP.IPAddr.Addr, true
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/avinetworks/sdk/go/models"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// newTestExporter returns an exporter that can map Avi objects without a
+// controller. Reverse DNS lookups are off.
+func newTestExporter(metrics GaugeOptsMap) (r *Exporter, c *catalog) {
+	r = new(Exporter)
+	r.config.Store(defaultConfig())
+	cfg := r.currentConfig()
+	cfg.Labels.ReverseDNS = false
+	r.config.Store(cfg)
+	r.malformed = newMalformedCounter()
+	r.counters = newCounterStore()
+	c = newCatalog(metrics, cfg.Metrics.Naming)
+	return
+}
+
+// malformedCount returns the value of avi_exporter_malformed_objects_total
+// for the kind.
+func malformedCount(t *testing.T, o *Exporter, kind string) float64 {
+	var m dto.Metric
+	if err := o.malformed.WithLabelValues(kind).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+// decodeFixture decodes a JSON fixture into v.
+func decodeFixture(t *testing.T, fixture string, v interface{}) {
+	if err := json.Unmarshal([]byte(fixture), v); err != nil {
+		t.Fatalf("decoding %s: %v", fixture, err)
+	}
+}
+
+func TestVirtualServiceAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+		address string
+		skipped float64
+	}{
+		{"inline VIP", `{"uuid":"vs-1","name":"vs1","vip":[{"ip_address":{"addr":"10.0.0.1","type":"V4"}}]}`, "10.0.0.1", 0},
+		{"no vip", `{"uuid":"vs-1","name":"vs1"}`, "", 1},
+		{"nil ip_address", `{"uuid":"vs-1","name":"vs1","vip":[{"vip_id":"0"}]}`, "", 1},
+		{"nil addr", `{"uuid":"vs-1","name":"vs1","vip":[{"ip_address":{"type":"V4"}}]}`, "", 1},
+		{"nil vip", `{"uuid":"vs-1","name":"vs1","vip":[null]}`, "", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, _ := newTestExporter(nil)
+			var v models.VirtualService
+			decodeFixture(t, tt.fixture, &v)
+			r, ok := o.newVirtualServiceDef(&v)
+			if !ok {
+				t.Fatal("virtual service was dropped")
+			}
+			if r.IPAddress != tt.address {
+				t.Errorf("address = %q, want %q", r.IPAddress, tt.address)
+			}
+			if got := malformedCount(t, o, "virtualservice"); got != tt.skipped {
+				t.Errorf("malformed virtualservice = %v, want %v", got, tt.skipped)
+			}
+		})
+	}
+}
+
+func TestServiceEngineAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+		address string
+		skipped float64
+	}{
+		{"management address", `{"uuid":"se-1","name":"se1","mgmt_vnic":{"vnic_networks":[{"ip":{"ip_addr":{"addr":"10.0.1.1","type":"V4"},"mask":24},"mode":"STATIC"}]}}`, "10.0.1.1", 0},
+		{"nil mgmt_vnic", `{"uuid":"se-1","name":"se1"}`, "", 1},
+		{"empty vnic_networks", `{"uuid":"se-1","name":"se1","mgmt_vnic":{"vnic_networks":[]}}`, "", 1},
+		{"nil ip", `{"uuid":"se-1","name":"se1","mgmt_vnic":{"vnic_networks":[{"mode":"DHCP"}]}}`, "", 1},
+		{"nil addr", `{"uuid":"se-1","name":"se1","mgmt_vnic":{"vnic_networks":[{"ip":{"ip_addr":{"type":"V4"},"mask":24}}]}}`, "", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, _ := newTestExporter(nil)
+			var v models.ServiceEngine
+			decodeFixture(t, tt.fixture, &v)
+			r, ok := o.newSeDef(&v)
+			if !ok {
+				t.Fatal("service engine was dropped")
+			}
+			if r.IPAddress != tt.address {
+				t.Errorf("address = %q, want %q", r.IPAddress, tt.address)
+			}
+			if got := malformedCount(t, o, "serviceengine"); got != tt.skipped {
+				t.Errorf("malformed serviceengine = %v, want %v", got, tt.skipped)
+			}
+		})
+	}
+}
+
+func TestMissingUUIDOrName(t *testing.T) {
+	o, _ := newTestExporter(nil)
+	var vs models.VirtualService
+	decodeFixture(t, `{"name":"vs1"}`, &vs)
+	if _, ok := o.newVirtualServiceDef(&vs); ok {
+		t.Error("virtual service without uuid was kept")
+	}
+	var se models.ServiceEngine
+	decodeFixture(t, `{"uuid":"se-1"}`, &se)
+	if _, ok := o.newSeDef(&se); ok {
+		t.Error("service engine without name was kept")
+	}
+	if _, ok := o.newSeDef(nil); ok {
+		t.Error("nil service engine was kept")
+	}
+	if got := malformedCount(t, o, "virtualservice"); got != 1 {
+		t.Errorf("malformed virtualservice = %v, want 1", got)
+	}
+	if got := malformedCount(t, o, "serviceengine"); got != 2 {
+		t.Errorf("malformed serviceengine = %v, want 2", got)
+	}
+}
+
+func TestSeriesValue(t *testing.T) {
+	metrics := GaugeOptsMap{
+		"l4_client.avg_bandwidth": {Type: "virtualservice", MetricID: "l4_client.avg_bandwidth", GaugeOpts: prometheus.GaugeOpts{Name: "l4_client_avg_bandwidth", Help: "h"}, CustomLabels: customLabels["virtualservice"]},
+		"l4_client.sum_conns":     {Type: "virtualservice", MetricID: "l4_client.sum_conns", GaugeOpts: prometheus.GaugeOpts{Name: "l4_client_sum_conns_total", Help: "h"}, CustomLabels: customLabels["virtualservice"], MetricType: "counter"},
+	}
+	tests := []struct {
+		name    string
+		key     string
+		fixture string
+		value   float64
+		ok      bool
+	}{
+		{"gauge", "l4_client.avg_bandwidth", `{"header":{"name":"l4_client.avg_bandwidth","entity_uuid":"vs-1"},"data":[{"value":1},{"value":2}]}`, 2, true},
+		{"gauge without data", "l4_client.avg_bandwidth", `{"header":{"name":"l4_client.avg_bandwidth","entity_uuid":"vs-1"},"data":[]}`, 0, false},
+		{"gauge without data field", "l4_client.avg_bandwidth", `{"header":{"name":"l4_client.avg_bandwidth","entity_uuid":"vs-1"}}`, 0, false},
+		{"counter without data", "l4_client.sum_conns", `{"header":{"name":"l4_client.sum_conns","entity_uuid":"vs-1"},"data":[]}`, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, c := newTestExporter(metrics)
+			var v CollectionResponse
+			decodeFixture(t, tt.fixture, &v)
+			value, ok := o.seriesValue(c, tt.key, v)
+			if ok != tt.ok || value != tt.value {
+				t.Errorf("seriesValue = %v, %v, want %v, %v", value, ok, tt.value, tt.ok)
+			}
+			want := 0.0
+			if !tt.ok {
+				want = 1
+			}
+			if got := malformedCount(t, o, "metric_series"); got != want {
+				t.Errorf("malformed metric_series = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestAddSeries(t *testing.T) {
+	metrics := GaugeOptsMap{
+		"l4_client.avg_bandwidth": {Type: "virtualservice", MetricID: "l4_client.avg_bandwidth", GaugeOpts: prometheus.GaugeOpts{Name: "l4_client_avg_bandwidth", Help: "h"}, CustomLabels: customLabels["virtualservice"]},
+	}
+	tests := []struct {
+		name    string
+		key     string
+		series  int
+		skipped float64
+	}{
+		{"known metric", "l4_client.avg_bandwidth", 1, 0},
+		{"unknown metric", "l4_client.avg_unknown", 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, c := newTestExporter(metrics)
+			m := new(metricSet)
+			o.addSeries(c, m, tt.key, prometheus.Labels{"name": "vs1", "entity_uuid": "vs-1"}, 1)
+			if len(m.metrics) != tt.series {
+				t.Errorf("series = %d, want %d", len(m.metrics), tt.series)
+			}
+			if got := malformedCount(t, o, "metric"); got != tt.skipped {
+				t.Errorf("malformed metric = %v, want %v", got, tt.skipped)
+			}
+		})
+	}
+}
@@ -8,8 +8,18 @@ type Runtime struct {
 		MgmtIP      string `json:"mgmt_ip"`
 		ClusterUUID string `json:"cluster_uuid"`
 	} `json:"node_info"`
+	ClusterState struct {
+		State string `json:"state"`
+	} `json:"cluster_state"`
 	NodeStates []struct {
+		Name   string `json:"name"`
 		MgmtIP string `json:"mgmt_ip"`
 		Role   string `json:"role"`
+		State  string `json:"state"`
 	} `json:"node_states"`
+	ServiceStates []struct {
+		Name        string `json:"name"`
+		ServiceName string `json:"service_name"`
+		State       string `json:"state"`
+	} `json:"service_states"`
 }
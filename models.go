@@ -1,14 +1,14 @@
 package main
 
 import (
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/avinetworks/sdk/go/clients"
+	"github.com/avinetworks/sdk/go/models"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-type guages map[string]*prometheus.GaugeVec
-
 // Connection describes the connection.
 type Connection struct {
 	UserName string
@@ -42,6 +42,8 @@ type CollectionResponse struct {
 		TenantUUID           string  `json:"tenant_uuid"`
 		Priority             bool    `json:"priority"`
 		EntityUUID           string  `json:"entity_uuid"`
+		PoolUUID             string  `json:"pool_uuid"`
+		ObjID                string  `json:"obj_id"`
 		Units                string  `json:"units"`
 		ObjIDType            string  `json:"obj_id_type"`
 		DerivationData       struct {
@@ -57,6 +59,34 @@ type CollectionResponse struct {
 	} `json:"data"`
 }
 
+// initialData describes the part of /api/initial-data the version is read
+// from.
+type initialData struct {
+	Version struct {
+		Version string `json:"Version"`
+		Build   int    `json:"build"`
+	} `json:"version"`
+}
+
+// eventLog is an event as listed by the analytics logs API.
+type eventLog struct {
+	EventID          string    `json:"event_id"`
+	Module           string    `json:"module"`
+	ObjType          string    `json:"obj_type"`
+	ObjName          string    `json:"obj_name"`
+	ObjUUID          string    `json:"obj_uuid"`
+	Tenant           string    `json:"tenant"`
+	Internal         string    `json:"internal"`
+	EventDescription string    `json:"event_description"`
+	ReportTimestamp  eventTime `json:"report_timestamp"`
+}
+
+// eventLogs describes a page of the analytics logs API.
+type eventLogs struct {
+	Count   int        `json:"count"`
+	Results []eventLog `json:"results"`
+}
+
 // MetricList is the marshalled return payload of default metrics on Avi.
 type MetricList struct {
 	MetricsData map[string]struct {
@@ -72,22 +102,170 @@ type connectionOpts struct {
 	password   string
 	tenant     string
 	cluster    string
+	host       string
 	apiVersion string
 }
 
-// DefaultMetrics describes the default list of Avi metrics.
+// TargetsConfig describes the targets file used by probe mode.
+type TargetsConfig struct {
+	Targets map[string]TargetConfig `json:"targets"`
+}
+
+// TargetConfig describes the connection settings for a single Avi cluster.
+type TargetConfig struct {
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	Tenant     string `json:"tenant"`
+	APIVersion string `json:"api_version"`
+}
+
+// Config describes the exporter configuration file.
+type Config struct {
+	Web        WebConfig               `json:"web"`
+	Avi        AviConfig               `json:"avi"`
+	Metrics    MetricsConfig           `json:"metrics"`
+	Labels     LabelsConfig            `json:"labels"`
+	Servers    ServersConfig           `json:"servers"`
+	Collectors CollectorsConfig        `json:"collectors"`
+	Targets    map[string]TargetConfig `json:"targets"`
+	Collect    CollectConfig           `json:"-"`
+}
+
+// CollectConfig describes how an exporter collects from Avi. It is set from
+// the command line and applies when the exporter starts.
+type CollectConfig struct {
+	Interval             time.Duration
+	Concurrency          int
+	Timeout              time.Duration
+	PoolMemberInterval   time.Duration
+	InventoryTTL         time.Duration
+	InventoryIncremental bool
+	Discovery            bool
+	DiscoveryInterval    time.Duration
+}
+
+// WebConfig describes the HTTP server.
+type WebConfig struct {
+	ListenAddress string `json:"listen_address"`
+	TelemetryPath string `json:"telemetry_path"`
+}
+
+// AviConfig describes the connection to the Avi controller.
+type AviConfig struct {
+	Cluster    string    `json:"cluster"`
+	Username   string    `json:"username"`
+	Password   string    `json:"password"`
+	Tenant     string    `json:"tenant"`
+	APIVersion string    `json:"api_version"`
+	TLS        TLSConfig `json:"tls"`
+}
+
+// TLSConfig describes how the controller certificate is verified. When
+// InsecureSkipVerify is left out, the certificate is only verified with a CA
+// file or a server name.
+type TLSConfig struct {
+	InsecureSkipVerify *bool  `json:"insecure_skip_verify"`
+	CAFile             string `json:"ca_file"`
+	ServerName         string `json:"server_name"`
+}
+
+// MetricsConfig describes which metrics are exported and where they are
+// defined.
+type MetricsConfig struct {
+	Include []string          `json:"include"`
+	Files   map[string]string `json:"files"`
+	Naming  NamingConfig      `json:"naming"`
+}
+
+// NamingConfig describes how metrics are named. Conformant names carry a
+// namespace per entity type and a base unit suffix instead of a units label.
+type NamingConfig struct {
+	Conformant bool              `json:"conformant"`
+	KeepLegacy bool              `json:"keep_legacy"`
+	Namespaces map[string]string `json:"namespaces"`
+}
+
+// ServersConfig describes which pool members get per-server metrics. Pools
+// are listed by name or uuid, and their servers by ip, ip:port or hostname.
+// "*" allows every server of a pool.
+type ServersConfig struct {
+	Pools map[string][]string `json:"pools"`
+}
+
+// CollectorsConfig describes which state collectors run. State metrics are
+// read from the Avi config and runtime APIs rather than from analytics.
+type CollectorsConfig struct {
+	PoolMembers     bool `json:"pool_members"`
+	VirtualServices bool `json:"virtual_services"`
+	ServiceEngines  bool `json:"service_engines"`
+	SEGroups        bool `json:"se_groups"`
+	Cluster         bool `json:"cluster"`
+	Certificates    bool `json:"certificates"`
+	Alerts          bool `json:"alerts"`
+	Events          bool `json:"events"`
+	LogEvents       bool `json:"log_events"`
+}
+
+// LabelsConfig describes how metric labels are filled in.
+type LabelsConfig struct {
+	ReverseDNS bool   `json:"reverse_dns"`
+	Cluster    string `json:"cluster"`
+}
+
+// inventoryOpts describes how the inventory cache is refreshed.
+type inventoryOpts struct {
+	ttl         time.Duration
+	incremental bool
+}
+
+// collectOpts describes how a collection is scheduled.
+type collectOpts struct {
+	interval           time.Duration
+	concurrency        int
+	timeout            time.Duration
+	poolMemberInterval time.Duration
+}
+
+// DefaultMetrics describes the default list of Avi metrics. Type, step,
+// limit, metric entity and reduction are optional.
 type DefaultMetrics []struct {
-	Metric string `json:"metric"`
-	Help   string `json:"help"`
+	Metric       string `json:"metric"`
+	Help         string `json:"help"`
+	MetricType   string `json:"type"`
+	Units        string `json:"units"`
+	Step         int    `json:"step"`
+	Limit        int    `json:"limit"`
+	MetricEntity string `json:"metric_entity"`
+	Reduction    string `json:"reduction"`
 }
 
 // Exporter describes the prometheus exporter.
 type Exporter struct {
-	GaugeOptsMap     GaugeOptsMap
-	AviClient        *clients.AviClient
-	connectionOpts   connectionOpts
-	userMetricString string
-	guages           guages
+	sessions       *sessionPool
+	config         atomic.Value
+	collectOpts    collectOpts
+	inventoryOpts  inventoryOpts
+	inventory      *inventory
+	libMetrics     atomic.Value
+	catalog        atomic.Value
+	catalogMtx     sync.Mutex
+	metrics        []prometheus.Metric
+	metricsMtx     sync.RWMutex
+	registry       atomic.Value
+	selfCollectors []prometheus.Collector
+	mtx            sync.Mutex
+	lastSuccess    prometheus.Gauge
+	relogins       prometheus.Counter
+	phaseMetrics   *phaseMetrics
+	malformed      *prometheus.CounterVec
+	counters       *counterStore
+	alerts         *alertStore
+	events         *eventStore
+	poolMembers    atomic.Value
+	units          atomic.Value
+	unitsOnce      sync.Once
+	done           chan struct{}
+	stopOnce       sync.Once
 }
 
 // Gauge describes the prometheus gauge.
@@ -106,8 +284,15 @@ type GaugeOptsMap map[string]GaugeOpts
 // GaugeOpts describes the custom GaugeOpts definition for mapping.
 type GaugeOpts struct {
 	Type         string
+	MetricID     string
 	GaugeOpts    prometheus.GaugeOpts
 	CustomLabels []string
+	MetricType   string
+	Units        string
+	Step         int
+	Limit        int
+	MetricEntity string
+	Reduction    string
 }
 
 // Metrics contains all the metrics.
@@ -122,13 +307,20 @@ type MetricRequest struct {
 	EntityUUID   string `json:"entity_uuid"`
 	MetricEntity string `json:"metric_entity,omitempty"`
 	MetricID     string `json:"metric_id"`
+	PoolUUID     string `json:"pool_uuid,omitempty"`
+	ObjID        string `json:"obj_id,omitempty"`
 }
 
 type virtualServiceDef struct {
-	Name      string
-	PoolUUID  string
-	IPAddress string `json:"ipaddress"`
-	FQDN      string `json:"fqdn"`
+	Name          string
+	TenantUUID    string
+	PoolUUID      string
+	PoolGroupUUID string
+	SEGroupUUID   string
+	CertUUIDs     []string
+	IPAddress     string `json:"ipaddress"`
+	FQDN          string `json:"fqdn"`
+	LastModified  string
 }
 
 type clusterDef struct {
@@ -138,13 +330,125 @@ type clusterDef struct {
 }
 
 type seDef struct {
-	IPAddress string `json:"ipaddress"`
-	FQDN      string `json:"fqdn"`
-	Name      string `json:"name"`
+	IPAddress        string `json:"ipaddress"`
+	FQDN             string `json:"fqdn"`
+	Name             string `json:"name"`
+	SEGroup          string
+	SEGroupUUID      string
+	Cloud            string
+	AvailabilityZone string
+	Hypervisor       string
+	EnableState      string
+	Resources        *models.SeResources
+	LastModified     string
 }
 
 type poolDef struct {
-	Name string
+	Name         string
+	Servers      []serverDef
+	LastModified string
+}
+
+type serverDef struct {
+	IPAddress string
+	Port      int32
+	Hostname  string
+}
+
+// virtualServiceRuntime is the runtime summary of a virtual service.
+type virtualServiceRuntime struct {
+	OperStatus models.OperationalStatus `json:"oper_status"`
+}
+
+// seRuntime is the runtime summary of a service engine.
+type seRuntime struct {
+	OperStatus  models.OperationalStatus `json:"oper_status"`
+	SeConnected bool                     `json:"se_connected"`
+	VsRef       []string                 `json:"vs_ref"`
+}
+
+// inventoryConfig is the part of the config of an object listed by an
+// inventory API that the exporter reads.
+type inventoryConfig struct {
+	UUID string `json:"uuid"`
+}
+
+// healthScore is the last health score of an object and its components,
+// which Avi computes every 5 minutes.
+type healthScore struct {
+	HealthScore      *float64 `json:"health_score"`
+	PerformanceScore *float64 `json:"performance_score"`
+	ResourcesPenalty *float64 `json:"resources_penalty"`
+	SecurityPenalty  *float64 `json:"security_penalty"`
+	AnomalyPenalty   *float64 `json:"anomaly_penalty"`
+}
+
+// virtualServiceInventory is a virtual service as listed by the
+// virtualservice-inventory API, along with its runtime and health score.
+type virtualServiceInventory struct {
+	UUID        string                `json:"uuid"`
+	Config      inventoryConfig       `json:"config"`
+	Runtime     virtualServiceRuntime `json:"runtime"`
+	HealthScore healthScore           `json:"health_score"`
+}
+
+// seInventory is a service engine as listed by the serviceengine-inventory
+// API, along with its runtime.
+type seInventory struct {
+	UUID    string          `json:"uuid"`
+	Config  inventoryConfig `json:"config"`
+	Runtime seRuntime       `json:"runtime"`
+}
+
+// poolMemberSnapshot is the last known runtime of the servers of every pool.
+// updated is when the servers of each pool were last read, and refreshed when
+// the pools were last listed.
+type poolMemberSnapshot struct {
+	servers   map[string][]serverRuntime
+	updated   map[string]time.Time
+	refreshed time.Time
+}
+
+// serverRuntime is a pool member as listed by the pool's server runtime API.
+type serverRuntime struct {
+	ServerIP struct {
+		Addr string `json:"addr"`
+	} `json:"server_ip"`
+	Port       int32                    `json:"port"`
+	Hostname   string                   `json:"hostname"`
+	OperStatus models.OperationalStatus `json:"oper_status"`
+}
+
+type seGroupDef struct {
+	Name       string
+	Cloud      string
+	HAMode     string
+	MaxSE      int32
+	BufferSE   int32
+	MaxVSPerSE int32
+}
+
+type certDef struct {
+	Name         string
+	TenantUUID   string
+	Type         string
+	CommonName   string
+	Issuer       string
+	SANs         []string
+	NotBefore    time.Time
+	NotAfter     time.Time
+	KeyAlgorithm string
+	KeySize      string
+}
+
+type alertConfigDef struct {
+	Name       string
+	ObjectType string
+}
+
+type poolGroupDef struct {
+	Name      string
+	PoolUUIDs []string
 }
 
 type cluster struct {
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// phaseMetrics describes the self-metrics reporting the health of each
+// collection phase.
+type phaseMetrics struct {
+	up       prometheus.Gauge
+	errors   *prometheus.CounterVec
+	duration *prometheus.GaugeVec
+}
+
+func newPhaseMetrics() (r *phaseMetrics) {
+	r = new(phaseMetrics)
+	r.up = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "avi_up",
+		Help: "Whether the Avi cluster answered at least one phase of the last collection that succeeded.",
+	})
+	r.errors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "avi_exporter_collect_errors_total",
+		Help: "Number of failed collections per phase.",
+	}, []string{"phase"})
+	r.duration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "avi_exporter_collect_duration_seconds",
+		Help: "Duration of the last collection per phase.",
+	}, []string{"phase"})
+	return
+}
+
+// runPhase runs one collection phase into a metric set of its own. Its
+// metrics are only added to m when the whole phase succeeded. It reports
+// whether the phase succeeded after getting an answer from Avi; phases that
+// were skipped or only used the inventory cache do not count.
+func (o *Exporter) runPhase(name string, s *scheduler, m *metricSet, fn func(*scheduler, *metricSet) error) (reached bool) {
+	start := time.Now()
+	errors := o.phaseMetrics.errors.WithLabelValues(name)
+	pm := new(metricSet)
+	ps := s.phase()
+	err := safeCall(func() error { return fn(ps, pm) })
+	o.phaseMetrics.duration.WithLabelValues(name).Set(time.Since(start).Seconds())
+	if err != nil {
+		err = fmt.Errorf("collecting %s metrics: %v", name, err)
+		log.Print(err)
+		errors.Inc()
+		m.fail(err)
+		return
+	}
+	m.add(pm.metrics...)
+	if pm.duplicates > 0 {
+		log.Printf("dropped %d duplicate %s series", pm.duplicates, name)
+		o.malformed.WithLabelValues("duplicate_series").Add(float64(pm.duplicates))
+	}
+	return ps.hasReached()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// poll runs a single scrape in the background.
+func (o *Exporter) poll() {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	o.scrape()
+}
+
+// startPoller collects in the background on the given interval.
+func (o *Exporter) startPoller(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			o.poll()
+			select {
+			case <-ticker.C:
+			case <-o.done:
+				return
+			}
+		}
+	}()
+}
+
+// newLastSuccessGauge returns the gauge reporting the age of the snapshot.
+func newLastSuccessGauge() prometheus.Gauge {
+	return prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "avi_exporter_last_success_timestamp_seconds",
+		Help: "Unix timestamp of the last successful collection from the Avi cluster.",
+	})
+}
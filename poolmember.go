@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/avinetworks/sdk/go/clients"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// poolMemberStates lists the states avi_pool_member_oper_state always has a
+// series for.
+var poolMemberStates = []string{"OPER_UP", "OPER_DOWN", "OPER_DISABLED"}
+
+// fetchServerRuntime retrieves the operational status of every server of the
+// pool. Pools deleted since the inventory was fetched have no servers.
+func (o *Exporter) fetchServerRuntime(ctx context.Context, uuid string) (r []serverRuntime, err error) {
+	err = o.withSession(ctx, func(c *clients.AviClient) error {
+		return c.AviSession.Get("api/pool/"+uuid+"/runtime/server", &r)
+	})
+	if isNotFound(err) {
+		return nil, nil
+	}
+	return
+}
+
+// currentPoolMembers returns the last pool member snapshot, if any.
+func (o *Exporter) currentPoolMembers() (r poolMemberSnapshot, ok bool) {
+	r, ok = o.poolMembers.Load().(poolMemberSnapshot)
+	return
+}
+
+// refreshPoolMembers fetches the server runtime of every pool, with its own
+// deadline and API call slots so that it does not hold up the collections.
+// Pools that fail keep their previous state and count as errors of the
+// pool_member phase; the others are refreshed all the same.
+func (o *Exporter) refreshPoolMembers(timeout time.Duration) (err error) {
+	ctx, cancel := contextUntil(o.done, timeout)
+	defer cancel()
+	pools, err := o.getPools(ctx)
+	if err != nil {
+		return
+	}
+	s := newScheduler(ctx, o.collectOpts.concurrency)
+	old, _ := o.currentPoolMembers()
+	var mtx sync.Mutex
+	servers := make(map[string][]serverRuntime)
+	updated := make(map[string]time.Time)
+	var fns []func() error
+	for uuid := range pools {
+		uuid := uuid
+		if v, ok := old.servers[uuid]; ok {
+			servers[uuid] = v
+			updated[uuid] = old.updated[uuid]
+		}
+		fns = append(fns, func() error {
+			var r []serverRuntime
+			if err := s.call(func() (err error) { r, err = o.fetchServerRuntime(s.ctx, uuid); return }); err != nil {
+				o.phaseMetrics.errors.WithLabelValues("pool_member").Inc()
+				return fmt.Errorf("pool %s: %v", pools[uuid].Name, err)
+			}
+			mtx.Lock()
+			defer mtx.Unlock()
+			servers[uuid] = r
+			updated[uuid] = time.Now()
+			return nil
+		})
+	}
+	err = s.run(fns...)
+	mtx.Lock()
+	defer mtx.Unlock()
+	// Calls still running past the deadline write to servers, so the
+	// snapshot gets a copy.
+	snapshot := poolMemberSnapshot{servers: make(map[string][]serverRuntime), updated: make(map[string]time.Time), refreshed: time.Now()}
+	for k, v := range servers {
+		snapshot.servers[k] = v
+		snapshot.updated[k] = updated[k]
+	}
+	o.poolMembers.Store(snapshot)
+	return
+}
+
+// startPoolMemberPoller refreshes the pool member state in the background on
+// the given interval, while the pool member collector is on.
+func (o *Exporter) startPoolMemberPoller(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if o.currentConfig().Collectors.PoolMembers {
+				if err := o.refreshPoolMembers(interval); err != nil {
+					log.Printf("refreshing pool members: %v", err)
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-o.done:
+				return
+			}
+		}
+	}()
+}
+
+// setPoolMemberMetrics reports the operational state of every pool member,
+// with the reason Avi gives for it, such as a failing health monitor. The
+// state comes from the last refresh of the pool member poller, which fails
+// the phase once it is more than 3 intervals old. Pools whose own state is
+// that old are left out.
+func (o *Exporter) setPoolMemberMetrics(s *scheduler, m *metricSet) (err error) {
+	if !o.currentConfig().Collectors.PoolMembers {
+		return
+	}
+	snapshot, ok := o.currentPoolMembers()
+	if !ok {
+		return
+	}
+	if snapshot.refreshed.IsZero() {
+		return fmt.Errorf("pool member state could not be refreshed yet")
+	}
+	maxAge := 3 * o.collectOpts.poolMemberInterval
+	if age := time.Since(snapshot.refreshed); age > maxAge {
+		return fmt.Errorf("pool member state is %v old", age.Truncate(time.Second))
+	}
+	c := o.currentCatalog()
+	var vs map[string]virtualServiceDef
+	var pools map[string]poolDef
+	var groups map[string]poolGroupDef
+	err = s.run(
+		func() error { return s.call(func() (err error) { vs, err = o.getVirtualServices(s.ctx); return }) },
+		func() error { return s.call(func() (err error) { pools, err = o.getPools(s.ctx); return }) },
+		func() error { return s.call(func() (err error) { groups, err = o.getPoolGroups(s.ctx); return }) },
+	)
+	if err != nil {
+		return
+	}
+	owners := poolOwners(vs, groups)
+	for uuid, p := range pools {
+		if time.Since(snapshot.updated[uuid]) > maxAge {
+			continue
+		}
+		hostnames := make(map[string]string)
+		for _, v := range p.Servers {
+			hostnames[v.objID()] = v.Hostname
+		}
+		for _, v := range snapshot.servers[uuid] {
+			if v.ServerIP.Addr == "" {
+				o.skip("pool_server", "no address on a server runtime of "+p.Name)
+				continue
+			}
+			server := serverDef{IPAddress: v.ServerIP.Addr, Port: v.Port, Hostname: v.Hostname}
+			if server.Hostname == "" {
+				server.Hostname = hostnames[server.objID()]
+			}
+			state := ""
+			if v.OperStatus.State != nil {
+				state = *v.OperStatus.State
+			}
+			var labels prometheus.Labels
+			labels = make(map[string]string)
+			labels["server_ip"] = server.IPAddress
+			labels["server_port"] = strconv.Itoa(int(server.Port))
+			labels["server_hostname"] = server.Hostname
+			labels["pool"] = p.Name
+			labels["virtualservice"] = strings.Join(owners[uuid], ",")
+			labels["reason"] = strings.Join(v.OperStatus.Reason, "; ")
+			labels["cluster"] = o.clusterLabel()
+			up := 0.0
+			if state == "OPER_UP" {
+				up = 1
+			}
+			metrics, err := c.newMetrics("avi_pool_member_up", labels, up)
+			if err != nil {
+				return err
+			}
+			m.add(metrics...)
+			if metrics, err = c.newStateSet("avi_pool_member_oper_state", labels, "state", poolMemberStates, state); err != nil {
+				return err
+			}
+			m.add(metrics...)
+		}
+	}
+	return
+}
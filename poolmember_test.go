@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestRefreshPoolMembersKeepsFailedPools(t *testing.T) {
+	var failing int32
+	server, _ := newFakeAPI(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/api/pool/pool-2/runtime/server" && atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error": "denied"}`))
+			return
+		}
+		w.Write([]byte(`[{"server_ip": {"addr": "10.0.0.1"}, "port": 80, "oper_status": {"state": "OPER_UP"}}]`))
+	})
+	defer server.Close()
+	o := newSessionTestExporter(server, 2)
+	o.phaseMetrics = newPhaseMetrics()
+	o.inventoryOpts.ttl = time.Hour
+	o.inventory = o.newInventory(newInventoryMetrics())
+	o.inventory.pools.value = map[string]poolDef{"pool-1": {Name: "pool1"}, "pool-2": {Name: "pool2"}}
+	o.inventory.pools.updated = time.Now()
+	if err := o.refreshPoolMembers(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := o.currentPoolMembers()
+	atomic.StoreInt32(&failing, 1)
+	if err := o.refreshPoolMembers(5 * time.Second); err == nil {
+		t.Error("failing pool was not reported")
+	}
+	second, _ := o.currentPoolMembers()
+	if !second.refreshed.After(first.refreshed) {
+		t.Error("refresh with a failing pool did not count")
+	}
+	if !second.updated["pool-1"].After(first.updated["pool-1"]) {
+		t.Error("pool-1 was not refreshed")
+	}
+	if !second.updated["pool-2"].Equal(first.updated["pool-2"]) || len(second.servers["pool-2"]) != 1 {
+		t.Errorf("pool-2 lost its previous state: %v", second.servers["pool-2"])
+	}
+	var m dto.Metric
+	if err := o.phaseMetrics.errors.WithLabelValues("pool_member").Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetCounter().GetValue(); got != 1 {
+		t.Errorf("pool_member errors = %v, want 1", got)
+	}
+}
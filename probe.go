@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// probeRegistry keeps one exporter per probed Avi cluster. lastUsed and
+// active tell which exporters are idle, and can be stopped.
+type probeRegistry struct {
+	mtx       sync.Mutex
+	config    Config
+	targets   TargetsConfig
+	exporters map[string]*Exporter
+	lastUsed  map[string]time.Time
+	active    map[string]int
+}
+
+// unknownTargetError is returned for targets missing from the targets.
+type unknownTargetError string
+
+func (o unknownTargetError) Error() string {
+	return fmt.Sprintf("unknown target %q", string(o))
+}
+
+// newProbeRegistry returns an empty registry for the targets of the config
+// file and of the targets file, if any. Exporters not probed for idleTimeout
+// are stopped, unless it is 0.
+func newProbeRegistry(c Config, path string, idleTimeout time.Duration) (r *probeRegistry, err error) {
+	r = new(probeRegistry)
+	r.config = c
+	r.exporters = make(map[string]*Exporter)
+	r.lastUsed = make(map[string]time.Time)
+	r.active = make(map[string]int)
+	if r.targets, err = loadTargets(c, path); err != nil {
+		return
+	}
+	if idleTimeout > 0 {
+		go func() {
+			ticker := time.NewTicker(idleTimeout / 2)
+			defer ticker.Stop()
+			for range ticker.C {
+				r.evict(idleTimeout)
+			}
+		}()
+	}
+	return
+}
+
+// loadTargets merges the targets of the config file and of the targets file.
+// The targets file wins on conflicts.
+func loadTargets(c Config, path string) (r TargetsConfig, err error) {
+	r.Targets = make(map[string]TargetConfig)
+	for k, v := range c.Targets {
+		r.Targets[k] = v
+	}
+	if path != "" {
+		err = fromJSONFile(path, &r)
+	}
+	return
+}
+
+// checkConfig reports whether every running exporter kept by the new targets
+// can switch to them, without applying them.
+func (o *probeRegistry) checkConfig(c Config, targets TargetsConfig) (err error) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	for target, e := range o.exporters {
+		if t, ok := targets.Targets[target]; ok {
+			if err = e.checkConfig(targetConfig(c, target, t)); err != nil {
+				return fmt.Errorf("target %s: %v", target, err)
+			}
+		}
+	}
+	return
+}
+
+// applyConfig switches the registry to new targets. The exporters of the
+// targets kept are reconfigured in place, and switched back if one of them
+// fails. Exporters of removed targets are then stopped.
+func (o *probeRegistry) applyConfig(c Config, targets TargetsConfig) (err error) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	var applied []string
+	for target, e := range o.exporters {
+		t, ok := targets.Targets[target]
+		if !ok {
+			continue
+		}
+		if err = e.applyConfig(targetConfig(c, target, t)); err != nil {
+			for _, v := range applied {
+				if err := o.exporters[v].applyConfig(targetConfig(o.config, v, o.targets.Targets[v])); err != nil {
+					log.Printf("restoring target %s: %v", v, err)
+				}
+			}
+			return fmt.Errorf("target %s: %v", target, err)
+		}
+		applied = append(applied, target)
+	}
+	for target := range o.exporters {
+		if _, ok := targets.Targets[target]; !ok {
+			o.remove(target)
+		}
+	}
+	o.config = c
+	o.targets = targets
+	return
+}
+
+// getExporter returns the exporter for the target, creating it on first use.
+// The exporter is in use until release is called.
+func (o *probeRegistry) getExporter(target string) (r *Exporter, err error) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	if r = o.exporters[target]; r == nil {
+		t, ok := o.targets.Targets[target]
+		if !ok {
+			err = unknownTargetError(target)
+			return
+		}
+		if r, err = newTargetExporter(o.config, target, t); err != nil {
+			return
+		}
+		o.exporters[target] = r
+	}
+	o.active[target]++
+	o.lastUsed[target] = time.Now()
+	return
+}
+
+// release marks the exporter of the target as no longer in use, unless it
+// was removed in the meantime.
+func (o *probeRegistry) release(target string, e *Exporter) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	if o.exporters[target] != e {
+		return
+	}
+	o.active[target]--
+	o.lastUsed[target] = time.Now()
+}
+
+// evict stops the exporters not in use for idleTimeout, along with their
+// background refreshes and sessions. They are created again on their next
+// probe.
+func (o *probeRegistry) evict(idleTimeout time.Duration) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	for target := range o.exporters {
+		if o.active[target] == 0 && time.Since(o.lastUsed[target]) >= idleTimeout {
+			log.Printf("stopping idle target %s", target)
+			o.remove(target)
+		}
+	}
+}
+
+// remove stops the exporter of the target and forgets it.
+func (o *probeRegistry) remove(target string) {
+	o.exporters[target].stop()
+	delete(o.exporters, target)
+	delete(o.lastUsed, target)
+	delete(o.active, target)
+}
+
+// probeHandler serves the metrics of the cluster named in the target parameter.
+func probeHandler(p *probeRegistry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		target := req.URL.Query().Get("target")
+		if target == "" {
+			http.Error(w, "target parameter is missing", http.StatusBadRequest)
+			return
+		}
+		e, err := p.getExporter(target)
+		if _, ok := err.(unknownTargetError); ok {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer p.release(target, e)
+		myPromHTTPHandler(e, e, promhttp.HandlerOpts{ErrorHandling: promhttp.ContinueOnError}).ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProbeHandlerStatus(t *testing.T) {
+	c := defaultConfig()
+	c.Metrics.Files["virtualservice"] = "lib/missing.json"
+	c.Targets = map[string]TargetConfig{"broken.example.com": {}}
+	p, err := newProbeRegistry(c, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		target string
+		status int
+	}{
+		{"", http.StatusBadRequest},
+		{"unknown.example.com", http.StatusNotFound},
+		{"broken.example.com", http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		probeHandler(p).ServeHTTP(w, httptest.NewRequest("GET", "/probe?target="+tt.target, nil))
+		if w.Code != tt.status {
+			t.Errorf("target %q: status = %d, want %d", tt.target, w.Code, tt.status)
+		}
+	}
+}
+
+func TestProbeRegistryEvict(t *testing.T) {
+	server, _ := newFakeController(nil)
+	defer server.Close()
+	c := defaultConfig()
+	c.Targets = map[string]TargetConfig{server.URL: {Username: "admin", Password: "password", APIVersion: "18.2.5"}}
+	p, err := newProbeRegistry(c, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := p.getExporter(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.evict(0)
+	if p.exporters[server.URL] != e {
+		t.Fatal("exporter in use was evicted")
+	}
+	p.release(server.URL, e)
+	p.evict(0)
+	if p.exporters[server.URL] != nil {
+		t.Fatal("idle exporter was kept")
+	}
+	select {
+	case <-e.done:
+	default:
+		t.Error("evicted exporter was not stopped")
+	}
+}
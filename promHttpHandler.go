@@ -61,7 +61,9 @@ func decorateWriter(request *http.Request, writer io.Writer, compressionDisabled
 // myPromHTTPHandler takes prometheus' existing handler and modifies it to include our collect operation.
 func myPromHTTPHandler(e *Exporter, reg prometheus.Gatherer, opts promhttp.HandlerOpts) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		e.Collect()
+		e.mtx.Lock()
+		defer e.mtx.Unlock()
+		e.scrape()
 		// START prometheus proprietary code.
 		mfs, err := reg.Gather()
 		if err != nil {
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// applyConfig validates c and switches the exporter to it. The metric catalog
+// is only swapped when the metric set changed. The session is dropped when the
+// connection settings changed, and the inventory when its labels may have.
+func (o *Exporter) applyConfig(c Config) (err error) {
+	lib, metrics, err := o.setPromMetricsMap(c)
+	if err != nil && !c.Collect.Discovery {
+		return
+	}
+	err = nil
+	old := o.currentConfig()
+	oldLib := o.currentLibMetrics()
+	o.config.Store(c)
+	o.libMetrics.Store(lib)
+	if c.Collect.Discovery {
+		go o.refreshCatalog()
+	} else if current := o.currentCatalog(); !sameMetrics(metrics, current.GaugeOptsMap) || !reflect.DeepEqual(c.Metrics.Naming, current.naming) {
+		if c.Metrics.Naming.Conformant {
+			o.startUnitLookup(time.Minute)
+		}
+		if err = o.setCatalog(newCatalog(metrics, c.Metrics.Naming)); err != nil {
+			o.config.Store(old)
+			o.libMetrics.Store(oldLib)
+			return
+		}
+		log.Printf("loaded %d metrics", len(metrics))
+	}
+	if !reflect.DeepEqual(old.Avi, c.Avi) {
+		o.resetSession()
+		o.inventory.reset()
+	} else if old.Labels != c.Labels {
+		o.inventory.reset()
+	}
+	return
+}
+
+// checkConfig reports whether c is valid and its metric files can be loaded,
+// without applying c. In discovery mode, the metric files may miss metrics the
+// controller's catalog provides.
+func (o *Exporter) checkConfig(c Config) (err error) {
+	if err = c.validate(); err != nil || c.Collect.Discovery {
+		return
+	}
+	_, _, err = o.setPromMetricsMap(c)
+	return
+}
+
+// stop ends the background goroutines of the exporter and closes its
+// sessions.
+func (o *Exporter) stop() {
+	o.stopOnce.Do(func() {
+		close(o.done)
+		o.closeSessions()
+	})
+}
+
+// fileStamp identifies a version of a watched file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// reloader reloads the configuration on SIGHUP, on POST /-/reload and when
+// one of the watched files changes. Settings that only apply at startup, such
+// as the listen address, are kept until the exporter restarts.
+type reloader struct {
+	mtx         sync.Mutex
+	path        string
+	targetsPath string
+	config      Config
+	exporter    *Exporter
+	probe       *probeRegistry
+	stamps      map[string]fileStamp
+	success     prometheus.Gauge
+	timestamp   prometheus.Gauge
+}
+
+// newReloader returns a reloader for the config in use. The exporter and the
+// probe registry are optional.
+func newReloader(c Config, path string, targetsPath string, e *Exporter, p *probeRegistry) (r *reloader) {
+	r = &reloader{path: path, targetsPath: targetsPath, config: c, exporter: e, probe: p}
+	r.success = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "avi_exporter_config_last_reload_successful",
+		Help: "Whether the last configuration reload attempt was successful.",
+	})
+	r.timestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "avi_exporter_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful configuration reload.",
+	})
+	prometheus.MustRegister(r.success, r.timestamp)
+	r.success.Set(1)
+	r.timestamp.SetToCurrentTime()
+	r.stamps = r.stat(c)
+	return
+}
+
+// files lists the files the configuration is read from.
+func (o *reloader) files(c Config) (r []string) {
+	for _, v := range []string{o.path, o.targetsPath} {
+		if v != "" {
+			r = append(r, v)
+		}
+	}
+	for _, v := range c.Metrics.Files {
+		r = append(r, v)
+	}
+	return
+}
+
+func (o *reloader) stat(c Config) (r map[string]fileStamp) {
+	r = make(map[string]fileStamp)
+	for _, v := range o.files(c) {
+		if fi, err := os.Stat(v); err == nil {
+			r[v] = fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+		}
+	}
+	return
+}
+
+// reload reads and validates every file again before applying any of it.
+func (o *reloader) reload() (err error) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	defer func() {
+		if err != nil {
+			o.success.Set(0)
+			log.Printf("reloading config: %v", err)
+			return
+		}
+		o.success.Set(1)
+		o.timestamp.SetToCurrentTime()
+		log.Println("config reloaded")
+	}()
+	c, err := loadConfig(o.path)
+	if err != nil {
+		o.stamps = o.stat(o.config)
+		return
+	}
+	applyFlags(&c)
+	o.stamps = o.stat(c)
+	if c.Web != o.config.Web {
+		log.Println("web settings changed, restart the exporter to apply them")
+		c.Web = o.config.Web
+	}
+	var targets TargetsConfig
+	if o.probe != nil {
+		if targets, err = loadTargets(c, o.targetsPath); err != nil {
+			return
+		}
+	}
+	if o.exporter != nil {
+		if err = o.exporter.checkConfig(c); err != nil {
+			return
+		}
+	}
+	if o.probe != nil {
+		if err = o.probe.checkConfig(c, targets); err != nil {
+			return
+		}
+	}
+	if o.exporter != nil {
+		if err = o.exporter.applyConfig(c); err != nil {
+			return
+		}
+	}
+	if o.probe != nil {
+		if err = o.probe.applyConfig(c, targets); err != nil {
+			if o.exporter != nil {
+				if err := o.exporter.applyConfig(o.config); err != nil {
+					log.Printf("restoring config: %v", err)
+				}
+			}
+			return
+		}
+	}
+	o.config = c
+	return
+}
+
+// changed reports whether a watched file changed since the last reload.
+func (o *reloader) changed() bool {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	return !reflect.DeepEqual(o.stamps, o.stat(o.config))
+}
+
+// start reloads on SIGHUP and, when interval is positive, whenever a watched
+// file changes.
+func (o *reloader) start(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		tick = ticker.C
+	}
+	go func() {
+		for {
+			select {
+			case <-hup:
+				o.reload()
+			case <-tick:
+				if o.changed() {
+					o.reload()
+				}
+			}
+		}
+	}()
+}
+
+// handler serves POST /-/reload.
+func (o *reloader) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := o.reload(); err != nil {
+			http.Error(w, fmt.Sprintf("failed to reload config: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("config reloaded\n"))
+	})
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/avinetworks/sdk/go/clients"
+)
+
+const (
+	// realtimeStep is the granularity of realtime metrics, which Avi only
+	// keeps for virtual services with realtime metrics enabled.
+	realtimeStep = 5
+	// fallbackStep is the 5-minute granularity Avi always keeps.
+	fallbackStep = 300
+)
+
+// metricEntities maps each entity type to the metric entity requested by
+// default.
+var metricEntities = map[string]string{
+	"virtualservice": "VSERVER_METRICS_ENTITY",
+	"serviceengine":  "SE_METRICS_ENTITY",
+	"controller":     "CONTROLLER_METRICS_ENTITY",
+	"pool":           "POOL_METRICS_ENTITY",
+}
+
+// reductions lists the functions a metric may use to reduce its data points
+// to a single value.
+var reductions = map[string]func(data []float64) float64{
+	"last": func(data []float64) float64 {
+		return data[len(data)-1]
+	},
+	"mean": func(data []float64) (r float64) {
+		for _, v := range data {
+			r += v
+		}
+		return r / float64(len(data))
+	},
+	"max": func(data []float64) (r float64) {
+		r = data[0]
+		for _, v := range data[1:] {
+			if v > r {
+				r = v
+			}
+		}
+		return
+	},
+	"sum": func(data []float64) (r float64) {
+		for _, v := range data {
+			r += v
+		}
+		return
+	},
+}
+
+// checkMetricSettings validates the optional settings of a metric definition.
+func checkMetricSettings(metric string, metricType string, step int, limit int, reduction string) (err error) {
+	if metricType != "" && metricType != "gauge" && metricType != "counter" {
+		return fmt.Errorf("%s: unknown type %q, must be gauge or counter", metric, metricType)
+	}
+	if step < 0 || limit < 0 {
+		return fmt.Errorf("%s: step and limit must not be negative", metric)
+	}
+	if _, ok := reductions[reduction]; reduction != "" && !ok {
+		return fmt.Errorf("%s: unknown reduction %q, must be one of last, mean, max or sum", metric, reduction)
+	}
+	return
+}
+
+// metricRequest builds the request for a metric, filling in the defaults of
+// its entity type. Pool metrics are requested for every pool of every
+// virtual service. Counters get enough data points to cover the collections
+// every interval.
+func (o GaugeOpts) metricRequest(interval time.Duration) (r MetricRequest) {
+	r = MetricRequest{EntityUUID: "*", MetricID: o.MetricID, Step: o.Step, Limit: o.Limit, MetricEntity: o.MetricEntity}
+	if o.Type == "pool" {
+		r.PoolUUID = "*"
+	}
+	if r.Step == 0 {
+		r.Step = realtimeStep
+	}
+	if r.Limit == 0 && o.MetricType == "counter" {
+		r.Limit = counterLimit(interval, r.Step)
+	}
+	if r.Limit == 0 {
+		r.Limit = 1
+	}
+	if r.MetricEntity == "" {
+		r.MetricEntity = metricEntities[o.Type]
+	}
+	return
+}
+
+// getMetrics collects every metric of the entity type in the catalog. When
+// scopes are given, each metric is requested once per scope, with the scope's
+// pool and object id. Series that came back without realtime data are
+// requested again, for their entity only, at the 5-minute granularity.
+func (o *Exporter) getMetrics(ctx context.Context, c *catalog, entityType string, scopes ...MetricRequest) (r []CollectionResponse, err error) {
+	req := Metrics{}
+	requests := make(map[string]MetricRequest)
+	for _, v := range c.GaugeOptsMap {
+		if v.Type != entityType {
+			continue
+		}
+		reqMetric := v.metricRequest(o.collectOpts.interval)
+		requests[v.MetricID] = reqMetric
+		if len(scopes) == 0 {
+			req.MetricRequests = append(req.MetricRequests, reqMetric)
+			continue
+		}
+		for _, scope := range scopes {
+			reqMetric.PoolUUID = scope.PoolUUID
+			reqMetric.ObjID = scope.ObjID
+			req.MetricRequests = append(req.MetricRequests, reqMetric)
+		}
+	}
+	series, err := o.postMetrics(ctx, req)
+	if err != nil {
+		return
+	}
+	fallback := Metrics{}
+	for _, v := range series {
+		reqMetric, ok := requests[v.Header.Name]
+		if len(v.Data) > 0 || !ok || reqMetric.Step >= fallbackStep {
+			r = append(r, v)
+			continue
+		}
+		reqMetric.EntityUUID = v.Header.EntityUUID
+		if v.Header.PoolUUID != "" {
+			reqMetric.PoolUUID = v.Header.PoolUUID
+		}
+		if v.Header.ObjID != "" {
+			reqMetric.ObjID = v.Header.ObjID
+		}
+		reqMetric.Step = fallbackStep
+		fallback.MetricRequests = append(fallback.MetricRequests, reqMetric)
+	}
+	series, err = o.postMetrics(ctx, fallback)
+	if err != nil {
+		return
+	}
+	r = append(r, series...)
+	return
+}
+
+// postMetrics sends a metrics collection request. Nothing is sent when there
+// are no metrics to request.
+func (o *Exporter) postMetrics(ctx context.Context, req Metrics) (r []CollectionResponse, err error) {
+	if len(req.MetricRequests) == 0 {
+		return
+	}
+	resp := make(map[string]map[string][]CollectionResponse)
+	err = o.withSession(ctx, func(c *clients.AviClient) error {
+		return c.AviSession.Post("/api/analytics/metrics/collection", req, &resp)
+	})
+	if err != nil {
+		return
+	}
+	for _, s := range resp["series"] {
+		r = append(r, s...)
+	}
+	return
+}
+
+// metricName returns the Prometheus name of an Avi metric. Counters get the
+// _total suffix.
+func metricName(id string, metricType string) (r string) {
+	r = strings.ReplaceAll(id, ".", "_")
+	if metricType == "counter" && !strings.HasSuffix(r, "_total") {
+		r += "_total"
+	}
+	return
+}
+
+// seriesValue reduces the data points of a metric series to a single value,
+// using the reduction of the metric's definition. The last data point is used
+// by default. Counters return their running total instead.
+func (o *Exporter) seriesValue(c *catalog, key string, v CollectionResponse) (r float64, ok bool) {
+	if c.GaugeOptsMap[key].MetricType == "counter" {
+		if r, ok = o.counters.add(v); !ok {
+			o.skip("metric_series", "no data points for "+v.Header.Name+" on "+v.Header.EntityUUID)
+		}
+		return
+	}
+	if len(v.Data) == 0 {
+		o.skip("metric_series", "no data points for "+v.Header.Name+" on "+v.Header.EntityUUID)
+		return
+	}
+	reduce, found := reductions[c.GaugeOptsMap[key].Reduction]
+	if !found {
+		reduce = reductions["last"]
+	}
+	data := make([]float64, len(v.Data))
+	for k, d := range v.Data {
+		data[k] = d.Value
+	}
+	return reduce(data), true
+}
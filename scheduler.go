@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// scheduler runs the steps of a collection concurrently. All steps share one
+// deadline, and the number of Avi API calls in flight is bounded by sem.
+// reached counts the calls that got an answer from Avi.
+type scheduler struct {
+	ctx     context.Context
+	sem     chan struct{}
+	reached *int32
+}
+
+// newScheduler returns a scheduler allowing up to concurrency API calls at once.
+func newScheduler(ctx context.Context, concurrency int) *scheduler {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &scheduler{ctx: ctx, sem: make(chan struct{}, concurrency), reached: new(int32)}
+}
+
+// phase returns a scheduler sharing the deadline and the slots of o, which
+// counts the calls that reached Avi on its own.
+func (o *scheduler) phase() *scheduler {
+	return &scheduler{ctx: o.ctx, sem: o.sem, reached: new(int32)}
+}
+
+// hasReached reports whether a call made through fetch got an answer from
+// Avi.
+func (o *scheduler) hasReached() bool {
+	return atomic.LoadInt32(o.reached) > 0
+}
+
+// run starts every fn in its own goroutine and waits until all of them have
+// returned or the deadline has passed. It returns the first error seen.
+func (o *scheduler) run(fns ...func() error) error {
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	var firstErr error
+	setErr := func(err error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, fn := range fns {
+		wg.Add(1)
+		go func(fn func() error) {
+			defer wg.Done()
+			if err := safeCall(fn); err != nil {
+				setErr(err)
+			}
+		}(fn)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-o.ctx.Done():
+		setErr(o.ctx.Err())
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	return firstErr
+}
+
+// call runs fn once a slot is free. It gives up when the deadline passes
+// while waiting for a slot.
+func (o *scheduler) call(fn func() error) (err error) {
+	select {
+	case o.sem <- struct{}{}:
+	case <-o.ctx.Done():
+		return o.ctx.Err()
+	}
+	defer func() { <-o.sem }()
+	return fn()
+}
+
+// fetch is call for API calls that always go to Avi, as opposed to lookups
+// that may be answered from the inventory cache. Calls that succeed show that
+// Avi is reachable.
+func (o *scheduler) fetch(fn func() error) (err error) {
+	if err = o.call(fn); err == nil {
+		atomic.AddInt32(o.reached, 1)
+	}
+	return
+}
+
+// contextUntil returns the context of API calls made apart from the
+// collections, which ends after timeout or once done is closed.
+func contextUntil(done <-chan struct{}, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// safeCall turns a panic in fn into an error so that one failing step cannot
+// take down the whole process.
+func safeCall(fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return fn()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// seGroupHAModes lists the HA modes of service engine groups.
+var seGroupHAModes = []string{"HA_MODE_SHARED_PAIR", "HA_MODE_SHARED", "HA_MODE_LEGACY_ACTIVE_STANDBY"}
+
+// seGroupStat describes how a se_stats metric of the member service engines
+// is aggregated into a group metric. unit is used when the series does not
+// carry a unit of the same kind.
+type seGroupStat struct {
+	name string
+	unit string
+	sum  bool
+}
+
+// seGroupStats lists the se_stats metrics aggregated per group.
+var seGroupStats = map[string]seGroupStat{
+	"se_stats.avg_cpu_usage": {"avi_serviceenginegroup_cpu_usage_ratio", "PERCENT", false},
+	"se_stats.avg_mem_usage": {"avi_serviceenginegroup_memory_usage_ratio", "PERCENT", false},
+	"se_stats.avg_bandwidth": {"avi_serviceenginegroup_bandwidth_bytes_per_second", "BITS_PER_SECOND", true},
+}
+
+// getServiceEngineStats requests the metrics of seGroupStats for every service
+// engine, at the 5-minute granularity which is always kept.
+func (o *Exporter) getServiceEngineStats(ctx context.Context) (r []CollectionResponse, err error) {
+	req := Metrics{}
+	for k := range seGroupStats {
+		req.MetricRequests = append(req.MetricRequests, MetricRequest{
+			EntityUUID:   "*",
+			MetricID:     k,
+			Step:         fallbackStep,
+			Limit:        1,
+			MetricEntity: metricEntities["serviceengine"],
+		})
+	}
+	return o.postMetrics(ctx, req)
+}
+
+// setServiceEngineGroupMetrics reports the capacity of every service engine
+// group next to its use: service engines and virtual services against their
+// configured maximums, and the usage of the member service engines.
+func (o *Exporter) setServiceEngineGroupMetrics(s *scheduler, m *metricSet) (err error) {
+	if !o.currentConfig().Collectors.SEGroups {
+		return
+	}
+	c := o.currentCatalog()
+	var groups map[string]seGroupDef
+	var ses map[string]seDef
+	var vs map[string]virtualServiceDef
+	var results []CollectionResponse
+	err = s.run(
+		func() error {
+			return s.call(func() (err error) { groups, err = o.getServiceEngineGroups(s.ctx); return })
+		},
+		func() error { return s.call(func() (err error) { ses, err = o.getServiceEngines(s.ctx); return }) },
+		func() error { return s.call(func() (err error) { vs, err = o.getVirtualServices(s.ctx); return }) },
+		func() error {
+			return s.fetch(func() (err error) { results, err = o.getServiceEngineStats(s.ctx); return })
+		},
+	)
+	if err != nil {
+		return
+	}
+	values := make(map[string]map[string]float64)
+	for uuid := range groups {
+		values[uuid] = map[string]float64{
+			"avi_serviceenginegroup_serviceengines":  0,
+			"avi_serviceenginegroup_virtualservices": 0,
+		}
+	}
+	for _, v := range ses {
+		if g, ok := values[v.SEGroupUUID]; ok {
+			g["avi_serviceenginegroup_serviceengines"]++
+		}
+	}
+	for _, v := range vs {
+		if g, ok := values[v.SEGroupUUID]; ok {
+			g["avi_serviceenginegroup_virtualservices"]++
+		}
+	}
+	//////////////////////////////////////////////////////////////////////////
+	// Aggregate the usage of the member service engines.
+	//////////////////////////////////////////////////////////////////////////
+	counts := make(map[string]map[string]float64)
+	for _, v1 := range results {
+		stat, ok := seGroupStats[v1.Header.Name]
+		if !ok {
+			continue
+		}
+		g, ok := values[ses[v1.Header.EntityUUID].SEGroupUUID]
+		if !ok {
+			continue
+		}
+		if len(v1.Data) == 0 {
+			o.skip("metric_series", "no data points for "+v1.Header.Name+" on "+v1.Header.EntityUUID)
+			continue
+		}
+		unit, found := baseUnits[strings.ToUpper(v1.Header.Units)]
+		if !found || unit.suffix != baseUnits[stat.unit].suffix {
+			unit = baseUnits[stat.unit]
+		}
+		uuid := ses[v1.Header.EntityUUID].SEGroupUUID
+		if counts[uuid] == nil {
+			counts[uuid] = make(map[string]float64)
+		}
+		counts[uuid][stat.name]++
+		g[stat.name] += v1.Data[len(v1.Data)-1].Value * unit.scale
+	}
+	for uuid, g := range values {
+		for _, stat := range seGroupStats {
+			if n := counts[uuid][stat.name]; n > 0 && !stat.sum {
+				g[stat.name] /= n
+			}
+		}
+	}
+	for uuid, group := range groups {
+		var labels prometheus.Labels
+		labels = make(map[string]string)
+		labels["se_group"] = group.Name
+		labels["cloud"] = group.Cloud
+		labels["cluster"] = o.clusterLabel()
+		g := values[uuid]
+		g["avi_serviceenginegroup_max_serviceengines"] = float64(group.MaxSE)
+		g["avi_serviceenginegroup_buffer_serviceengines"] = float64(group.BufferSE)
+		g["avi_serviceenginegroup_max_virtualservices_per_serviceengine"] = float64(group.MaxVSPerSE)
+		for name, value := range g {
+			metrics, err := c.newMetrics(name, labels, value)
+			if err != nil {
+				return err
+			}
+			m.add(metrics...)
+		}
+		if group.HAMode != "" {
+			metrics, err := c.newStateSet("avi_serviceenginegroup_ha_mode", labels, "ha_mode", seGroupHAModes, group.HAMode)
+			if err != nil {
+				return err
+			}
+			m.add(metrics...)
+		}
+	}
+	return
+}
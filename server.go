@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// objID returns the identifier Avi uses for the server in metric requests.
+func (o serverDef) objID() string {
+	return net.JoinHostPort(o.IPAddress, strconv.Itoa(int(o.Port)))
+}
+
+// allows reports whether an allow-list entry matches the server.
+func (o serverDef) allows(entry string) bool {
+	return entry == "*" || entry == o.IPAddress || entry == o.objID() || (o.Hostname != "" && entry == o.Hostname)
+}
+
+// allowedServers returns the servers of the pool that get per-server metrics.
+// Pools missing from the allow-list get none.
+func allowedServers(c ServersConfig, uuid string, p poolDef) (r []serverDef) {
+	entries, ok := c.Pools[p.Name]
+	if !ok {
+		entries = c.Pools[uuid]
+	}
+	for _, s := range p.Servers {
+		for _, entry := range entries {
+			if s.allows(entry) {
+				r = append(r, s)
+				break
+			}
+		}
+	}
+	return
+}
+
+// setServerMetrics collects the metrics of the allowed pool members. The
+// servers are only known once the pools are, so the metrics are requested
+// after the inventory lookups.
+func (o *Exporter) setServerMetrics(s *scheduler, m *metricSet) (err error) {
+	c := o.currentCatalog()
+	if !c.collects("server") {
+		return
+	}
+	var vs map[string]virtualServiceDef
+	var pools map[string]poolDef
+	var groups map[string]poolGroupDef
+	err = s.run(
+		func() error { return s.call(func() (err error) { vs, err = o.getVirtualServices(s.ctx); return }) },
+		func() error { return s.call(func() (err error) { pools, err = o.getPools(s.ctx); return }) },
+		func() error { return s.call(func() (err error) { groups, err = o.getPoolGroups(s.ctx); return }) },
+	)
+	if err != nil {
+		return
+	}
+	cfg := o.currentConfig().Servers
+	servers := make(map[string]serverDef)
+	var scopes []MetricRequest
+	for uuid, p := range pools {
+		for _, v := range allowedServers(cfg, uuid, p) {
+			servers[uuid+"/"+v.objID()] = v
+			scopes = append(scopes, MetricRequest{PoolUUID: uuid, ObjID: v.objID()})
+		}
+	}
+	if len(scopes) == 0 {
+		return
+	}
+	var results []CollectionResponse
+	if err = s.fetch(func() (err error) { results, err = o.getMetrics(s.ctx, c, "server", scopes...); return }); err != nil {
+		return
+	}
+	owners := poolOwners(vs, groups)
+	for _, v1 := range results {
+		server, ok := servers[v1.Header.PoolUUID+"/"+v1.Header.ObjID]
+		if !ok {
+			o.skip("metric_series", "unknown server "+v1.Header.ObjID+" in pool "+v1.Header.PoolUUID)
+			continue
+		}
+		owner := strings.Join(owners[v1.Header.PoolUUID], ",")
+		if v, ok := vs[v1.Header.EntityUUID]; ok {
+			owner = v.Name
+		}
+		var labels prometheus.Labels
+		labels = make(map[string]string)
+		labels["server_ip"] = server.IPAddress
+		labels["server_port"] = strconv.Itoa(int(server.Port))
+		labels["server_hostname"] = server.Hostname
+		labels["pool"] = pools[v1.Header.PoolUUID].Name
+		labels["virtualservice"] = owner
+		labels["tenant_uuid"] = v1.Header.TenantUUID
+		labels["cluster"] = o.clusterLabel()
+		labels["units"] = v1.Header.Units
+		key := metricKey("server", v1.Header.Name)
+		value, ok := o.seriesValue(c, key, v1)
+		if !ok {
+			continue
+		}
+		o.addSeries(c, m, key, labels, value)
+	}
+	return
+}
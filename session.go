@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/avinetworks/sdk/go/clients"
+	"github.com/avinetworks/sdk/go/session"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// isSessionError reports whether err means the Avi session is no longer
+// valid, either because it expired or because the CSRF token was rejected.
+// Other 403s are permission errors, which a new login does not fix.
+func isSessionError(err error) bool {
+	aviErr, ok := err.(session.AviError)
+	if !ok {
+		return false
+	}
+	switch aviErr.HttpStatusCode {
+	case 401, 419:
+		return true
+	}
+	if aviErr.Message == nil {
+		return false
+	}
+	msg := strings.ToLower(*aviErr.Message)
+	return strings.Contains(msg, "csrf") || strings.Contains(msg, "authenticat")
+}
+
+// isNotFound reports whether err means the object no longer exists in Avi.
+func isNotFound(err error) bool {
+	aviErr, ok := err.(session.AviError)
+	return ok && aviErr.HttpStatusCode == 404
+}
+
+// sessionPool hands out the Avi sessions of an exporter. The SDK updates the
+// cookies of a session on every response without a lock, so each session is
+// used by one API call at a time. Calls keep their session until they return,
+// which bounds the API calls in flight on the controller across collections.
+type sessionPool struct {
+	sessions   chan *pooledSession
+	mtx        sync.Mutex
+	generation int
+}
+
+// pooledSession is a session of the pool, which logs in on first use.
+// generation tells whether it was made with the current connection settings,
+// ctx is the context of the API call using it, and conns the transport
+// holding its connections.
+type pooledSession struct {
+	client     *clients.AviClient
+	generation int
+	ctx        context.Context
+	conns      *http.Transport
+}
+
+// newSessionPool returns a pool of size sessions.
+func newSessionPool(size int) (r *sessionPool) {
+	if size < 1 {
+		size = 1
+	}
+	r = &sessionPool{sessions: make(chan *pooledSession, size)}
+	for i := 0; i < size; i++ {
+		r.sessions <- new(pooledSession)
+	}
+	return
+}
+
+func (o *sessionPool) currentGeneration() int {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	return o.generation
+}
+
+// reset makes every session log in again before its next use, including the
+// sessions in use.
+func (o *sessionPool) reset() {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	o.generation++
+}
+
+// transport returns the transport of a session of the pool. The SDK takes an
+// *http.Transport and no context, so the requests of the session go through
+// a callTransport registered for https.
+func (o *pooledSession) transport(t *http.Transport, relogins prometheus.Counter) (r *http.Transport) {
+	// An empty TLSNextProto keeps HTTP/2 from taking over https.
+	r = &http.Transport{TLSNextProto: make(map[string]func(string, *tls.Conn) http.RoundTripper)}
+	o.conns = t
+	r.RegisterProtocol("https", callTransport{session: o, transport: t, relogins: relogins})
+	return
+}
+
+// callTransport sends the requests of a pooled session with the context of
+// the API call using the session. It also counts the logins of a session
+// that is already logged in: the SDK logs in again by itself when a request
+// gets a 401, without telling its caller.
+type callTransport struct {
+	session   *pooledSession
+	transport *http.Transport
+	relogins  prometheus.Counter
+}
+
+// RoundTrip implements http.RoundTripper. Once the context of the call is
+// done, it answers 504 without reaching Avi: on a failed request after a 5xx,
+// the SDK polls the controller status with sleeps growing to minutes, while it
+// gives up on a 504 after a few short retries.
+func (o callTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	call := o.session.ctx
+	if err := call.Err(); err != nil {
+		return &http.Response{
+			Status:     "504 Gateway Timeout",
+			StatusCode: http.StatusGatewayTimeout,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     make(http.Header),
+			Body:       ioutil.NopCloser(strings.NewReader(strconv.Quote(err.Error()))),
+			Request:    req,
+		}, nil
+	}
+	if o.session.client != nil && strings.HasSuffix(req.URL.Path, "/login") {
+		log.Println("avi session expired, logging in again")
+		o.relogins.Inc()
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	go func() {
+		select {
+		case <-call.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	resp, err := o.transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = cancelOnClose{resp.Body, cancel}
+	return resp, nil
+}
+
+// cancelOnClose cancels the context of a request once its response body is
+// closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close implements io.Closer.
+func (o cancelOnClose) Close() error {
+	defer o.cancel()
+	return o.ReadCloser.Close()
+}
+
+// acquireSession waits for a free session and logs it in when needed. It
+// gives up when ctx is done first.
+func (o *Exporter) acquireSession(ctx context.Context) (r *pooledSession, err error) {
+	select {
+	case r = <-o.sessions.sessions:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	r.ctx = ctx
+	if generation := o.sessions.currentGeneration(); r.client == nil || r.generation != generation {
+		r.generation = generation
+		r.client = nil
+		if r.client, err = o.connect(r); err != nil {
+			o.releaseSession(r)
+			return nil, err
+		}
+	}
+	return
+}
+
+// releaseSession puts a session back into the pool. Once the exporter is
+// stopped, the session is closed first.
+func (o *Exporter) releaseSession(s *pooledSession) {
+	s.ctx = nil
+	select {
+	case <-o.done:
+		s.close()
+	default:
+	}
+	o.sessions.sessions <- s
+}
+
+// close drops the session and its connections to Avi.
+func (o *pooledSession) close() {
+	if o.conns != nil {
+		o.conns.CloseIdleConnections()
+	}
+	o.client = nil
+	o.conns = nil
+}
+
+// closeSessions closes the sessions not in use. The others are closed when
+// they are released.
+func (o *Exporter) closeSessions() {
+	for i := 0; i < cap(o.sessions.sessions); i++ {
+		select {
+		case s := <-o.sessions.sessions:
+			s.close()
+			o.sessions.sessions <- s
+		default:
+			return
+		}
+	}
+}
+
+// resetSession makes every session log in again with the current connection
+// settings.
+func (o *Exporter) resetSession() {
+	o.sessions.reset()
+}
+
+// withSession runs fn with a session of its own, with ctx for its requests.
+// When the session turns out to be expired, it logs in again and retries fn
+// once; the login is counted by the session's callTransport. The session is
+// only released once fn returns, even after ctx is done, so that calls left
+// behind by a collection still count against the pool.
+func (o *Exporter) withSession(ctx context.Context, fn func(c *clients.AviClient) error) (err error) {
+	s, err := o.acquireSession(ctx)
+	if err != nil {
+		return
+	}
+	defer o.releaseSession(s)
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}()
+	err = fn(s.client)
+	if !isSessionError(err) {
+		return
+	}
+	if s.client, err = o.connect(s); err != nil {
+		s.client = nil
+		return
+	}
+	return fn(s.client)
+}
+
+// newReloginsCounter returns the counter of session re-authentications.
+func newReloginsCounter() prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "avi_exporter_session_relogins_total",
+		Help: "Number of times the exporter had to log in to the Avi cluster again after its session expired.",
+	})
+}
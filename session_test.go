@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/avinetworks/sdk/go/clients"
+	"github.com/avinetworks/sdk/go/session"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// newFakeController returns a TLS server answering like an Avi controller,
+// with new session cookies on every response. status, when set, answers the
+// API calls instead.
+func newFakeController(status func(r *http.Request) int) (r *httptest.Server, logins *int32) {
+	return newFakeAPI(func(w http.ResponseWriter, req *http.Request) {
+		if status != nil {
+			if code := status(req); code != http.StatusOK {
+				w.WriteHeader(code)
+				w.Write([]byte(`{"error": "denied"}`))
+				return
+			}
+		}
+		w.Write([]byte(`{}`))
+	})
+}
+
+// newFakeAPI returns a fake controller whose API calls are answered by api.
+func newFakeAPI(api http.HandlerFunc) (r *httptest.Server, logins *int32) {
+	logins = new(int32)
+	r = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := strconv.FormatInt(time.Now().UnixNano(), 36)
+		http.SetCookie(w, &http.Cookie{Name: "csrftoken", Value: "csrf" + n})
+		http.SetCookie(w, &http.Cookie{Name: "sessionid", Value: "session" + n})
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case req.URL.Path == "/login":
+			atomic.AddInt32(logins, 1)
+		case strings.HasPrefix(req.URL.Path, "/api/"):
+			api(w, req)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	return
+}
+
+// newSessionTestExporter returns an exporter connecting to the server.
+func newSessionTestExporter(server *httptest.Server, concurrency int) (r *Exporter) {
+	r = new(Exporter)
+	c := defaultConfig()
+	c.Avi.Cluster = server.URL
+	c.Avi.Username = "admin"
+	c.Avi.Password = "password"
+	c.Avi.APIVersion = "18.2.5"
+	r.config.Store(c)
+	r.collectOpts = collectOpts{concurrency: concurrency, timeout: 5 * time.Second}
+	r.sessions = newSessionPool(concurrency)
+	r.relogins = newReloginsCounter()
+	return
+}
+
+func TestWithSessionConcurrent(t *testing.T) {
+	server, _ := newFakeController(nil)
+	defer server.Close()
+	o := newSessionTestExporter(server, 4)
+	var wg sync.WaitGroup
+	errs := make(chan error, 32)
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- o.withSession(context.Background(), func(c *clients.AviClient) error {
+				var r interface{}
+				return c.AviSession.Get("api/cluster", &r)
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestWithSessionDeadline(t *testing.T) {
+	release := make(chan struct{})
+	server, _ := newFakeController(func(req *http.Request) int {
+		if req.URL.Path == "/api/slow" {
+			select {
+			case <-release:
+			case <-req.Context().Done():
+			}
+		}
+		return http.StatusOK
+	})
+	defer server.Close()
+	defer close(release)
+	o := newSessionTestExporter(server, 1)
+	get := func(ctx context.Context, uri string) error {
+		return o.withSession(ctx, func(c *clients.AviClient) error {
+			var r interface{}
+			return c.AviSession.Get(uri, &r)
+		})
+	}
+	// Log in first, so that the deadline only applies to the slow call.
+	if err := get(context.Background(), "api/cluster"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := get(ctx, "api/slow"); err != context.DeadlineExceeded {
+		t.Errorf("slow call: err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("slow call returned after %v", elapsed)
+	}
+	// The slow call gave its session back, so the next call gets it.
+	if err := get(context.Background(), "api/cluster"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWithSessionWaitsForFreeSession(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	server, _ := newFakeController(nil)
+	defer server.Close()
+	o := newSessionTestExporter(server, 1)
+	done := make(chan error)
+	go func() {
+		done <- o.withSession(context.Background(), func(c *clients.AviClient) error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := o.withSession(ctx, func(c *clients.AviClient) error { return nil })
+	if err != context.DeadlineExceeded {
+		t.Errorf("err = %v, want %v while the only session is in use", err, context.DeadlineExceeded)
+	}
+	close(release)
+	if err = <-done; err != nil {
+		t.Error(err)
+	}
+	if err = o.withSession(context.Background(), func(c *clients.AviClient) error { return nil }); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIsSessionError(t *testing.T) {
+	message := func(s string) *string { return &s }
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"expired", session.AviError{HttpStatusCode: 401}, true},
+		{"login timeout", session.AviError{HttpStatusCode: 419}, true},
+		{"permission denied", session.AviError{HttpStatusCode: 403, Message: message("map[detail:You do not have permission to perform this action.]")}, false},
+		{"csrf rejected", session.AviError{HttpStatusCode: 403, Message: message("map[detail:CSRF Failed: CSRF token missing or incorrect.]")}, true},
+		{"not authenticated", session.AviError{HttpStatusCode: 403, Message: message("map[detail:Authentication credentials were not provided.]")}, true},
+		{"not found", session.AviError{HttpStatusCode: 404}, false},
+		{"other error", context.DeadlineExceeded, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isSessionError(tt.err); got != tt.want {
+				t.Errorf("isSessionError = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithSessionRelogins(t *testing.T) {
+	var expired int32
+	server, logins := newFakeController(func(req *http.Request) int {
+		switch req.URL.Path {
+		case "/api/denied":
+			return http.StatusForbidden
+		case "/api/expired":
+			if atomic.CompareAndSwapInt32(&expired, 0, 1) {
+				return http.StatusUnauthorized
+			}
+		}
+		return http.StatusOK
+	})
+	defer server.Close()
+	o := newSessionTestExporter(server, 1)
+	get := func(uri string) error {
+		return o.withSession(context.Background(), func(c *clients.AviClient) error {
+			var r interface{}
+			return c.AviSession.Get(uri, &r)
+		})
+	}
+	relogins := func() float64 {
+		var m dto.Metric
+		if err := o.relogins.Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+	if err := get("api/cluster"); err != nil {
+		t.Fatal(err)
+	}
+	// A permission error is returned as is.
+	if err := get("api/denied"); err == nil {
+		t.Error("denied call succeeded")
+	}
+	if got := atomic.LoadInt32(logins); got != 1 || relogins() != 0 {
+		t.Errorf("after a 403: logins = %d, relogins = %v, want 1, 0", got, relogins())
+	}
+	// The SDK logs in again by itself on a 401, which is counted as well.
+	if err := get("api/expired"); err != nil {
+		t.Error(err)
+	}
+	if got := atomic.LoadInt32(logins); got != 2 || relogins() != 1 {
+		t.Errorf("after a 401: logins = %d, relogins = %v, want 2, 1", got, relogins())
+	}
+}
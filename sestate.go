@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// serviceEngineOperStates lists the states avi_serviceengine_oper_state
+// always has a series for.
+var serviceEngineOperStates = []string{"OPER_UP", "OPER_DOWN", "OPER_PARTITIONED", "OPER_INITIALIZING"}
+
+// serviceEngineEnableStates lists the enable states of service engines.
+var serviceEngineEnableStates = []string{"SE_STATE_ENABLED", "SE_STATE_DISABLED_FOR_PLACEMENT", "SE_STATE_DISABLED", "SE_STATE_DISABLED_FORCE"}
+
+// fetchServiceEngineInventory retrieves the runtime of every service engine,
+// a page of service engines per call.
+func (o *Exporter) fetchServiceEngineInventory(ctx context.Context) (r map[string]seRuntime, err error) {
+	r = make(map[string]seRuntime)
+	params := map[string]string{"include": "config,runtime"}
+	err = o.fetchPages(ctx, "api/serviceengine-inventory", params, func(obj json.RawMessage) error {
+		var v seInventory
+		if err := json.Unmarshal(obj, &v); err != nil {
+			return err
+		}
+		if v.UUID == "" {
+			v.UUID = v.Config.UUID
+		}
+		if v.UUID == "" {
+			o.skip("serviceengine_inventory", "missing uuid")
+			return nil
+		}
+		r[v.UUID] = v.Runtime
+		return nil
+	})
+	return
+}
+
+// setServiceEngineStateMetrics reports the state of every service engine and
+// the resources it was given. The resources come from the inventory cache;
+// the state from the serviceengine-inventory API.
+func (o *Exporter) setServiceEngineStateMetrics(s *scheduler, m *metricSet) (err error) {
+	if !o.currentConfig().Collectors.ServiceEngines {
+		return
+	}
+	c := o.currentCatalog()
+	var ses map[string]seDef
+	var runtimes map[string]seRuntime
+	err = s.run(
+		func() error { return s.call(func() (err error) { ses, err = o.getServiceEngines(s.ctx); return }) },
+		func() error {
+			return s.fetch(func() (err error) { runtimes, err = o.fetchServiceEngineInventory(s.ctx); return })
+		},
+	)
+	if err != nil {
+		return
+	}
+	for uuid, v := range ses {
+		var labels prometheus.Labels
+		labels = make(map[string]string)
+		labels["name"] = v.Name
+		labels["entity_uuid"] = uuid
+		labels["ipaddress"] = v.IPAddress
+		labels["se_group"] = v.SEGroup
+		labels["cluster"] = o.clusterLabel()
+		labels["cloud"] = v.Cloud
+		labels["availability_zone"] = v.AvailabilityZone
+		labels["hypervisor"] = v.Hypervisor
+		values := make(map[string]float64)
+		if r := v.Resources; r != nil {
+			if r.NumVcpus != nil {
+				values["avi_serviceengine_vcpus"] = float64(*r.NumVcpus)
+			}
+			if r.Memory != nil {
+				values["avi_serviceengine_memory_bytes"] = float64(*r.Memory) * (1 << 20)
+			}
+			if r.Disk != nil {
+				values["avi_serviceengine_disk_bytes"] = float64(*r.Disk) * (1 << 30)
+			}
+			values["avi_serviceengine_hyperthreading"] = 0
+			if r.HyperThreading != nil && *r.HyperThreading {
+				values["avi_serviceengine_hyperthreading"] = 1
+			}
+		}
+		for name, value := range values {
+			metrics, err := c.newMetrics(name, labels, value)
+			if err != nil {
+				return err
+			}
+			m.add(metrics...)
+		}
+		if v.EnableState != "" {
+			metrics, err := c.newStateSet("avi_serviceengine_enable_state", labels, "state", serviceEngineEnableStates, v.EnableState)
+			if err != nil {
+				return err
+			}
+			m.add(metrics...)
+		}
+		runtime, ok := runtimes[uuid]
+		if !ok {
+			continue
+		}
+		state := ""
+		if runtime.OperStatus.State != nil {
+			state = *runtime.OperStatus.State
+		}
+		values = map[string]float64{
+			"avi_serviceengine_oper_up":         0,
+			"avi_serviceengine_connected":       0,
+			"avi_serviceengine_virtualservices": float64(len(runtime.VsRef)),
+		}
+		if state == "OPER_UP" {
+			values["avi_serviceengine_oper_up"] = 1
+		}
+		if runtime.SeConnected {
+			values["avi_serviceengine_connected"] = 1
+		}
+		for name, value := range values {
+			metrics, err := c.newMetrics(name, labels, value)
+			if err != nil {
+				return err
+			}
+			m.add(metrics...)
+		}
+		metrics, err := c.newStateSet("avi_serviceengine_oper_state", labels, "state", serviceEngineOperStates, state)
+		if err != nil {
+			return err
+		}
+		m.add(metrics...)
+	}
+	return
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// stateMetric describes a metric read from the Avi config and runtime APIs
+// instead of the analytics API. Its name and labels are fixed.
+type stateMetric struct {
+	help   string
+	labels []string
+}
+
+// stateCounters lists the state metrics that are counters rather than gauges.
+var stateCounters = map[string]bool{"avi_alerts_total": true, "avi_events_total": true}
+
+// virtualServiceStateLabels are the labels of virtual service state metrics,
+// those of virtual service metrics without units.
+var virtualServiceStateLabels = []string{"name", "entity_uuid", "fqdn", "ipaddress", "pool", "tenant_uuid", "cluster"}
+
+// serviceEngineStateLabels are the labels of service engine state metrics.
+var serviceEngineStateLabels = []string{"name", "entity_uuid", "ipaddress", "se_group", "cloud", "availability_zone", "hypervisor", "cluster"}
+
+// seGroupStateLabels are the labels of service engine group state metrics.
+var seGroupStateLabels = []string{"se_group", "cloud", "cluster"}
+
+// controllerNodeStateLabels are the labels of controller node state metrics.
+var controllerNodeStateLabels = []string{"node", "mgmt_ip", "cluster"}
+
+// certificateStateLabels are the labels of certificate state metrics.
+var certificateStateLabels = []string{"name", "common_name", "issuer", "sans_hash", "tenant_uuid", "virtualservices", "cluster"}
+
+// stateMetrics lists the state metrics by name.
+var stateMetrics = map[string]stateMetric{
+	"avi_pool_member_up": {
+		"Whether the pool member is operationally up.",
+		[]string{"server_ip", "server_port", "server_hostname", "pool", "virtualservice", "reason", "cluster"},
+	},
+	"avi_pool_member_oper_state": {
+		"Operational state of the pool member, 1 for the current state.",
+		[]string{"server_ip", "server_port", "server_hostname", "pool", "virtualservice", "state", "reason", "cluster"},
+	},
+	"avi_virtualservice_oper_up": {
+		"Whether the virtual service is operationally up.",
+		virtualServiceStateLabels,
+	},
+	"avi_virtualservice_health_score": {
+		"Health score of the virtual service, from 0 to 100.",
+		virtualServiceStateLabels,
+	},
+	"avi_virtualservice_health_performance_score": {
+		"Performance score the health score of the virtual service starts from.",
+		virtualServiceStateLabels,
+	},
+	"avi_virtualservice_health_resources_penalty": {
+		"Penalty on the health score of the virtual service for resource usage.",
+		virtualServiceStateLabels,
+	},
+	"avi_virtualservice_health_security_penalty": {
+		"Penalty on the health score of the virtual service for security threats.",
+		virtualServiceStateLabels,
+	},
+	"avi_virtualservice_health_anomaly_penalty": {
+		"Penalty on the health score of the virtual service for anomalies.",
+		virtualServiceStateLabels,
+	},
+	"avi_serviceengine_oper_up": {
+		"Whether the service engine is operationally up.",
+		serviceEngineStateLabels,
+	},
+	"avi_serviceengine_oper_state": {
+		"Operational state of the service engine, 1 for the current state.",
+		append([]string{"state"}, serviceEngineStateLabels...),
+	},
+	"avi_serviceengine_connected": {
+		"Whether the service engine is connected to the controller.",
+		serviceEngineStateLabels,
+	},
+	"avi_serviceengine_enable_state": {
+		"Enable state of the service engine, 1 for the current state.",
+		append([]string{"state"}, serviceEngineStateLabels...),
+	},
+	"avi_serviceengine_virtualservices": {
+		"Number of virtual services placed on the service engine.",
+		serviceEngineStateLabels,
+	},
+	"avi_serviceengine_vcpus": {
+		"Number of vCPUs of the service engine.",
+		serviceEngineStateLabels,
+	},
+	"avi_serviceengine_memory_bytes": {
+		"Memory of the service engine.",
+		serviceEngineStateLabels,
+	},
+	"avi_serviceengine_disk_bytes": {
+		"Disk size of the service engine.",
+		serviceEngineStateLabels,
+	},
+	"avi_serviceengine_hyperthreading": {
+		"Whether hyper-threading is enabled on the service engine.",
+		serviceEngineStateLabels,
+	},
+	"avi_serviceenginegroup_max_serviceengines": {
+		"Maximum number of service engines in the group.",
+		seGroupStateLabels,
+	},
+	"avi_serviceenginegroup_serviceengines": {
+		"Number of service engines in the group.",
+		seGroupStateLabels,
+	},
+	"avi_serviceenginegroup_buffer_serviceengines": {
+		"Number of service engines the group keeps for HA failover.",
+		seGroupStateLabels,
+	},
+	"avi_serviceenginegroup_ha_mode": {
+		"HA mode of the group, 1 for the current mode.",
+		append([]string{"ha_mode"}, seGroupStateLabels...),
+	},
+	"avi_serviceenginegroup_max_virtualservices_per_serviceengine": {
+		"Maximum number of virtual services placed on a service engine of the group.",
+		seGroupStateLabels,
+	},
+	"avi_serviceenginegroup_virtualservices": {
+		"Number of virtual services placed on the group.",
+		seGroupStateLabels,
+	},
+	"avi_serviceenginegroup_cpu_usage_ratio": {
+		"Average CPU usage of the service engines of the group.",
+		seGroupStateLabels,
+	},
+	"avi_serviceenginegroup_memory_usage_ratio": {
+		"Average memory usage of the service engines of the group.",
+		seGroupStateLabels,
+	},
+	"avi_serviceenginegroup_bandwidth_bytes_per_second": {
+		"Total bandwidth of the service engines of the group.",
+		seGroupStateLabels,
+	},
+	"avi_controller_node_up": {
+		"Whether the controller node is active in the cluster.",
+		controllerNodeStateLabels,
+	},
+	"avi_controller_node_role": {
+		"Role of the controller node, 1 for the current role.",
+		append([]string{"role"}, controllerNodeStateLabels...),
+	},
+	"avi_controller_service_up": {
+		"Whether the controller service is active on the node.",
+		append([]string{"service"}, controllerNodeStateLabels...),
+	},
+	"avi_controller_cluster_state": {
+		"State of the controller cluster, 1 for the current state.",
+		[]string{"state", "cluster"},
+	},
+	"avi_controller_cluster_info": {
+		"Controller cluster information, with the current leader node.",
+		[]string{"cluster_uuid", "leader", "cluster"},
+	},
+	"avi_controller_build_info": {
+		"Version and build of the controller answering the exporter.",
+		[]string{"version", "build", "cluster_uuid", "cluster"},
+	},
+	"avi_ssl_certificate_not_after_timestamp_seconds": {
+		"Time after which the certificate is no longer valid.",
+		certificateStateLabels,
+	},
+	"avi_ssl_certificate_not_before_timestamp_seconds": {
+		"Time before which the certificate is not valid yet.",
+		certificateStateLabels,
+	},
+	"avi_ssl_certificate_info": {
+		"Certificate information, with the type and key of the certificate.",
+		[]string{"name", "tenant_uuid", "type", "key_algorithm", "key_size", "cluster"},
+	},
+	"avi_alert_active": {
+		"Number of active alerts.",
+		[]string{"alert_config", "level", "object_type", "object_name", "tenant", "cluster"},
+	},
+	"avi_alerts_total": {
+		"Number of alerts raised since the exporter started.",
+		[]string{"level", "cluster"},
+	},
+	"avi_events_total": {
+		"Number of events logged since the exporter started.",
+		[]string{"event_id", "module", "object_type", "cluster"},
+	},
+}
+
+// newStateSet builds one series per state, with the state in the given label,
+// set to 1 for the current state and 0 for the others. A current state missing
+// from states gets a series too. labels is not modified.
+func (o *catalog) newStateSet(name string, labels prometheus.Labels, label string, states []string, current string) (r []prometheus.Metric, err error) {
+	found := false
+	for _, v := range states {
+		found = found || v == current
+	}
+	if !found && current != "" {
+		states = append(states[:len(states):len(states)], current)
+	}
+	l := make(prometheus.Labels, len(labels)+1)
+	for k, v := range labels {
+		l[k] = v
+	}
+	for _, v := range states {
+		l[label] = v
+		value := 0.0
+		if v == current {
+			value = 1
+		}
+		metrics, err := o.newMetrics(name, l, value)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, metrics...)
+	}
+	return
+}
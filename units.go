@@ -0,0 +1,148 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// baseUnit describes how values in an Avi unit convert to a Prometheus base
+// unit, and the suffix that unit adds to metric names.
+type baseUnit struct {
+	suffix string
+	scale  float64
+}
+
+// baseUnits maps the metric_units of Avi metrics to their base units. Metrics
+// in units missing from this list keep their legacy name.
+var baseUnits = map[string]baseUnit{
+	"METRIC_COUNT":           {"", 1},
+	"PER_SECOND":             {"_per_second", 1},
+	"SEC":                    {"_seconds", 1},
+	"SECONDS":                {"_seconds", 1},
+	"MILLISECONDS":           {"_seconds", 1e-3},
+	"MICROSECONDS":           {"_seconds", 1e-6},
+	"MIN":                    {"_seconds", 60},
+	"HOURS":                  {"_seconds", 3600},
+	"DAYS":                   {"_seconds", 86400},
+	"PERCENT":                {"_ratio", 1e-2},
+	"RATIO":                  {"_ratio", 1},
+	"BYTES":                  {"_bytes", 1},
+	"KILO_BYTES":             {"_bytes", 1 << 10},
+	"MEGA_BYTES":             {"_bytes", 1 << 20},
+	"GIGA_BYTES":             {"_bytes", 1 << 30},
+	"KB":                     {"_bytes", 1 << 10},
+	"MB":                     {"_bytes", 1 << 20},
+	"GB":                     {"_bytes", 1 << 30},
+	"BYTES_PER_SECOND":       {"_bytes_per_second", 1},
+	"KILO_BYTES_PER_SECOND":  {"_bytes_per_second", 1 << 10},
+	"BITS_PER_SECOND":        {"_bytes_per_second", 1.0 / 8},
+	"KILO_BITS_PER_SECOND":   {"_bytes_per_second", 1e3 / 8},
+	"MEGA_BITS_PER_SECOND":   {"_bytes_per_second", 1e6 / 8},
+	"GIGA_BITS_PER_SECOND":   {"_bytes_per_second", 1e9 / 8},
+	"MBPS":                   {"_bytes_per_second", 1e6 / 8},
+	"PACKETS_PER_SECOND":     {"_packets_per_second", 1},
+	"CONNECTIONS_PER_SECOND": {"_connections_per_second", 1},
+}
+
+// conformantName returns the name of a metric in the conformant naming mode,
+// along with the factor converting its values to the base unit. ok is false
+// while the units of the metric are unknown or have no base unit.
+func conformantName(opts GaugeOpts, n NamingConfig) (r string, scale float64, ok bool) {
+	if opts.Units == "" {
+		return
+	}
+	unit, found := baseUnits[strings.ToUpper(opts.Units)]
+	if !found {
+		return
+	}
+	r = strings.ReplaceAll(opts.MetricID, ".", "_")
+	if !strings.HasSuffix(r, unit.suffix) {
+		r += unit.suffix
+	}
+	if opts.MetricType == "counter" {
+		r += "_total"
+	}
+	if ns := n.Namespaces[opts.Type]; ns != "" {
+		r = ns + "_" + r
+	}
+	return r, unit.scale, true
+}
+
+// withoutLabel returns labels without the given label.
+func withoutLabel(labels []string, label string) (r []string) {
+	for _, v := range labels {
+		if v != label {
+			r = append(r, v)
+		}
+	}
+	return
+}
+
+// fillUnits sets the units of the metrics that do not declare theirs, using
+// the units known from the controller's catalog.
+func fillUnits(m GaugeOptsMap, units map[string]string) {
+	for k, v := range m {
+		if v.Units == "" && units[v.MetricID] != "" {
+			v.Units = units[v.MetricID]
+			m[k] = v
+		}
+	}
+}
+
+func (o *Exporter) currentUnits() map[string]string {
+	r, _ := o.units.Load().(map[string]string)
+	return r
+}
+
+// storeUnits keeps the units of every metric of the controller's catalog.
+func (o *Exporter) storeUnits(list MetricList) {
+	units := make(map[string]string)
+	for k, v := range list.MetricsData {
+		units[k] = v.MetricUnits
+	}
+	o.units.Store(units)
+}
+
+// startUnitLookup fetches the metric units from the controller's catalog once,
+// retrying every interval until it succeeds, and then reloads the metric
+// catalog so that metrics whose units were unknown get their conformant name.
+// Discovery reads the same catalog, so it does not need the lookup.
+func (o *Exporter) startUnitLookup(interval time.Duration) {
+	o.unitsOnce.Do(func() {
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				ctx, cancel := contextUntil(o.done, o.collectOpts.timeout)
+				list, err := o.fetchMetricList(ctx)
+				cancel()
+				if err == nil {
+					o.storeUnits(list)
+					o.reloadMetrics()
+					return
+				}
+				log.Printf("looking up metric units: %v", err)
+				select {
+				case <-ticker.C:
+				case <-o.done:
+					return
+				}
+			}
+		}()
+	})
+}
+
+// reloadMetrics rebuilds the metric catalog from the current configuration.
+func (o *Exporter) reloadMetrics() {
+	c := o.currentConfig()
+	lib, metrics, err := o.setPromMetricsMap(c)
+	if err != nil {
+		log.Printf("reloading metrics: %v", err)
+		return
+	}
+	o.libMetrics.Store(lib)
+	if err = o.setCatalog(newCatalog(metrics, c.Metrics.Naming)); err != nil {
+		log.Printf("registering metrics: %v", err)
+	}
+}
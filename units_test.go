@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestConformantName(t *testing.T) {
+	n := NamingConfig{Namespaces: map[string]string{"virtualservice": "avi_virtualservice"}}
+	tests := []struct {
+		id, units, metricType string
+		name                  string
+		scale                 float64
+		ok                    bool
+	}{
+		{"l4_client.avg_bandwidth", "BITS_PER_SECOND", "", "avi_virtualservice_l4_client_avg_bandwidth_bytes_per_second", 1.0 / 8, true},
+		{"l4_client.avg_rx_bytes", "KILO_BYTES_PER_SECOND", "", "avi_virtualservice_l4_client_avg_rx_bytes_bytes_per_second", 1 << 10, true},
+		{"l4_client.avg_bandwidth", "MBPS", "", "avi_virtualservice_l4_client_avg_bandwidth_bytes_per_second", 1e6 / 8, true},
+		{"l7_client.avg_uptime", "MIN", "", "avi_virtualservice_l7_client_avg_uptime_seconds", 60, true},
+		{"l7_client.avg_uptime", "HOURS", "", "avi_virtualservice_l7_client_avg_uptime_seconds", 3600, true},
+		{"l7_client.avg_uptime", "DAYS", "", "avi_virtualservice_l7_client_avg_uptime_seconds", 86400, true},
+		{"l4_client.avg_rx_bytes", "KB", "", "avi_virtualservice_l4_client_avg_rx_bytes", 1 << 10, true},
+		{"l4_client.avg_rx_bytes", "MB", "", "avi_virtualservice_l4_client_avg_rx_bytes", 1 << 20, true},
+		{"l4_client.avg_rx_bytes", "GB", "", "avi_virtualservice_l4_client_avg_rx_bytes", 1 << 30, true},
+		{"l4_client.sum_conns", "METRIC_COUNT", "counter", "avi_virtualservice_l4_client_sum_conns_total", 1, true},
+		{"l4_client.avg_bandwidth", "", "", "", 0, false},
+		{"l4_client.avg_bandwidth", "FURLONGS", "", "", 0, false},
+	}
+	for _, tt := range tests {
+		opts := GaugeOpts{Type: "virtualservice", MetricID: tt.id, Units: tt.units, MetricType: tt.metricType}
+		name, scale, ok := conformantName(opts, n)
+		if name != tt.name || scale != tt.scale || ok != tt.ok {
+			t.Errorf("%s in %q: got %q, %v, %v, want %q, %v, %v", tt.id, tt.units, name, scale, ok, tt.name, tt.scale, tt.ok)
+		}
+	}
+}
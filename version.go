@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/avinetworks/sdk/go/clients"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// detectVersion returns the version of the controller, e.g. 18.2.5.
+func detectVersion(c *clients.AviClient) (r string, err error) {
+	var data initialData
+	if err = c.AviSession.Get("api/initial-data", &data); err != nil {
+		return
+	}
+	if data.Version.Version == "" {
+		err = fmt.Errorf("no version in /api/initial-data")
+		return
+	}
+	return data.Version.Version, nil
+}
+
+// splitVersion splits a node version such as 18.2.5-9012-20190822.033225
+// into the release and the build number.
+func splitVersion(v string) (version string, build string) {
+	parts := strings.SplitN(v, "-", 3)
+	version = parts[0]
+	if len(parts) > 1 {
+		build = parts[1]
+	}
+	return
+}
+
+// setBuildInfoMetrics reports the version of the controller. While a cluster
+// is upgraded, the version changes as the exporter reaches upgraded nodes.
+func (o *Exporter) setBuildInfoMetrics(s *scheduler, m *metricSet, f *runtimeFetch) (err error) {
+	c := o.currentCatalog()
+	runtime, err := f.get(o, s)
+	if err != nil {
+		return
+	}
+	var labels prometheus.Labels
+	labels = make(map[string]string)
+	labels["version"], labels["build"] = splitVersion(runtime.NodeInfo.Version)
+	labels["cluster_uuid"] = runtime.NodeInfo.ClusterUUID
+	labels["cluster"] = o.clusterLabel()
+	metrics, err := c.newMetrics("avi_controller_build_info", labels, 1)
+	if err != nil {
+		return
+	}
+	m.add(metrics...)
+	return
+}
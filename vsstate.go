@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// healthScoreMetrics maps the state metrics to the component of the health
+// score they report.
+var healthScoreMetrics = map[string]func(healthScore) *float64{
+	"avi_virtualservice_health_score":             func(v healthScore) *float64 { return v.HealthScore },
+	"avi_virtualservice_health_performance_score": func(v healthScore) *float64 { return v.PerformanceScore },
+	"avi_virtualservice_health_resources_penalty": func(v healthScore) *float64 { return v.ResourcesPenalty },
+	"avi_virtualservice_health_security_penalty":  func(v healthScore) *float64 { return v.SecurityPenalty },
+	"avi_virtualservice_health_anomaly_penalty":   func(v healthScore) *float64 { return v.AnomalyPenalty },
+}
+
+// fetchVirtualServiceInventory retrieves the runtime and the health score of
+// every virtual service, a page of virtual services per call.
+func (o *Exporter) fetchVirtualServiceInventory(ctx context.Context) (r map[string]virtualServiceInventory, err error) {
+	r = make(map[string]virtualServiceInventory)
+	params := map[string]string{"include": "config,runtime,health_score"}
+	err = o.fetchPages(ctx, "api/virtualservice-inventory", params, func(obj json.RawMessage) error {
+		var v virtualServiceInventory
+		if err := json.Unmarshal(obj, &v); err != nil {
+			return err
+		}
+		if v.UUID == "" {
+			v.UUID = v.Config.UUID
+		}
+		if v.UUID == "" {
+			o.skip("virtualservice_inventory", "missing uuid")
+			return nil
+		}
+		r[v.UUID] = v
+		return nil
+	})
+	return
+}
+
+// setVirtualServiceStateMetrics reports the operational status and the health
+// score of every virtual service, as the Avi UI shows them.
+func (o *Exporter) setVirtualServiceStateMetrics(s *scheduler, m *metricSet) (err error) {
+	if !o.currentConfig().Collectors.VirtualServices {
+		return
+	}
+	c := o.currentCatalog()
+	var vs map[string]virtualServiceDef
+	var pools map[string]poolDef
+	var inventory map[string]virtualServiceInventory
+	err = s.run(
+		func() error { return s.call(func() (err error) { vs, err = o.getVirtualServices(s.ctx); return }) },
+		func() error { return s.call(func() (err error) { pools, err = o.getPools(s.ctx); return }) },
+		func() error {
+			return s.fetch(func() (err error) { inventory, err = o.fetchVirtualServiceInventory(s.ctx); return })
+		},
+	)
+	if err != nil {
+		return
+	}
+	for uuid, v := range vs {
+		state, ok := inventory[uuid]
+		if !ok {
+			continue
+		}
+		var labels prometheus.Labels
+		labels = make(map[string]string)
+		labels["name"] = v.Name
+		labels["entity_uuid"] = uuid
+		labels["fqdn"] = v.FQDN
+		labels["ipaddress"] = v.IPAddress
+		labels["pool"] = pools[v.PoolUUID].Name
+		labels["tenant_uuid"] = v.TenantUUID
+		labels["cluster"] = o.clusterLabel()
+		values := map[string]float64{"avi_virtualservice_oper_up": 0}
+		if state.Runtime.OperStatus.State != nil && *state.Runtime.OperStatus.State == "OPER_UP" {
+			values["avi_virtualservice_oper_up"] = 1
+		}
+		for name, component := range healthScoreMetrics {
+			if value := component(state.HealthScore); value != nil {
+				values[name] = *value
+			}
+		}
+		for name, value := range values {
+			metrics, err := c.newMetrics(name, labels, value)
+			if err != nil {
+				return err
+			}
+			m.add(metrics...)
+		}
+	}
+	return
+}